@@ -2,46 +2,166 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/iberryful/sproxy/pkg/client"
 	"github.com/iberryful/sproxy/pkg/log"
+	"github.com/iberryful/sproxy/pkg/pipe"
+	"github.com/iberryful/sproxy/pkg/transport"
 	"github.com/pkg/profile"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var (
+	user          string
 	secret        string
 	remoteAddr    string
 	listenAddr    string
 	logLevel      string
 	poolSize      int
 	enableProfile bool
+	window        uint
+	mux           bool
 	timeout       time.Duration
+	caPath        string
+	serverName    string
+	pin           string
+	certPath      string
+	keyPath       string
+	padding       string
+	compress      string
+	maxFrame      int
+	pingTimeout   time.Duration
+	cover         time.Duration
+	resume        bool
+	transportName string
+	path          string
+	host          string
+	camoPath      string
+	camoHost      string
+	camoHeader    = headerFlag{}
+	maxInFlight   int
 )
 
+// headerFlag collects the "Name: value" headers of repeated flags.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected Name: value", s)
+	}
+	http.Header(h).Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
 func init() {
 	//runtime.GOMAXPROCS(32)
+	flag.StringVar(&user, "u", "", "user ID")
 	flag.StringVar(&secret, "s", "secret", "secret")
 	flag.StringVar(&remoteAddr, "r", "127.0.0.1:7443", "remote addr")
 	flag.StringVar(&listenAddr, "l", "127.0.0.1:2080", "local listen addr")
 	flag.StringVar(&logLevel, "v", "info", "log level")
 	flag.IntVar(&poolSize, "c", 32, "connection pool size")
 	flag.BoolVar(&enableProfile, "p", false, "enable profile")
+	flag.UintVar(&window, "w", 256*1024, "initial receive window of a multiplexed stream")
+	flag.BoolVar(&mux, "m", false, "multiplex connections over shared pipes")
 	flag.DurationVar(&timeout, "t", 1*time.Minute, "timeout for idle connection in pool")
+	flag.StringVar(&caPath, "ca", "", "CA bundle to verify the server certificate")
+	flag.StringVar(&serverName, "sni", "", "server name sent and verified, host of the remote addr by default")
+	flag.StringVar(&pin, "pin", "", "base64 SHA-256 pin of the server public key")
+	flag.StringVar(&certPath, "cert", "", "client certificate for mutual TLS")
+	flag.StringVar(&keyPath, "key", "", "client private key for mutual TLS")
+	flag.StringVar(&padding, "pad", "none", "frame padding: none, bucket or random")
+	flag.StringVar(&compress, "z", "none", "compression algorithms in order of preference: none or deflate")
+	flag.DurationVar(&cover, "cover", 0, "mean interval of cover pings on idle pipes, 0 to disable")
+	flag.IntVar(&maxFrame, "frame", 0, "largest frame payload requested, up to 1 MiB, 0 for the default")
+	flag.DurationVar(&pingTimeout, "ping", 3*time.Second, "timeout of the ping verifying an idle pipe before use")
+	flag.BoolVar(&resume, "resume", false, "resume connections across broken pipes by reconnecting to the server")
+	flag.StringVar(&transportName, "transport", "tls", "transport of pipes: tls, tcp, ws, wss or h2")
+	flag.StringVar(&path, "path", "/", "request path of the ws, wss and h2 transports")
+	flag.StringVar(&host, "host", "", "Host header of the ws, wss and h2 transports, the remote addr by default")
+	flag.StringVar(&camoPath, "camo-path", "", "path of the HTTP/1.1 request starting connections, enables the camouflage")
+	flag.StringVar(&camoHost, "camo-host", "", "Host header of the camouflage request, the remote addr by default")
+	flag.Var(camoHeader, "camo-header", "header of the camouflage request, repeated for each header, browser like headers by default")
+	flag.IntVar(&maxInFlight, "max-inflight", 0, "largest number of pipes used at once, connections beyond it wait up to 30s, 0 for no limit")
 	flag.Parse()
 	log.SetLevel(logLevel)
 }
 
 func main() {
+	if len(user) > 255 {
+		log.Fatal("user ID too long")
+	}
+	if maxFrame != 0 && (maxFrame < pipe.MinFrameSize || maxFrame > pipe.MaxFrameLimit) {
+		log.Fatalf("frame size must be between %d and %d", pipe.MinFrameSize, pipe.MaxFrameLimit)
+	}
+	pad, err := pipe.ParsePadding(padding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	compression, err := pipe.ParseCompression(compress)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if enableProfile {
 		defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
 	}
 	o := &client.ClientOption{
-		ListenAddr: listenAddr,
-		RemoteAddr: remoteAddr,
-		Secret:     secret,
-		PoolSize:   poolSize,
-		Timeout:    timeout,
+		ListenAddr:    listenAddr,
+		RemoteAddr:    remoteAddr,
+		User:          user,
+		Secret:        secret,
+		PoolSize:      poolSize,
+		Timeout:       timeout,
+		Mux:           mux,
+		Window:        uint32(window),
+		CAPath:        caPath,
+		ServerName:    serverName,
+		PinSHA256:     pin,
+		CertPath:      certPath,
+		KeyPath:       keyPath,
+		Padding:       pad,
+		Compress:      compression,
+		MaxFrameSize:  maxFrame,
+		PingTimeout:   pingTimeout,
+		CoverInterval: cover,
+		Resume:        resume,
+		Transport:     transportName,
+		Path:          path,
+		Host:          host,
+		MaxInFlight:   maxInFlight,
+	}
+	if camoPath != "" {
+		o.Camouflage = &transport.Camouflage{
+			Path:   camoPath,
+			Host:   camoHost,
+			Header: http.Header(camoHeader),
+		}
+	}
+	c, err := client.New(o)
+	if err != nil {
+		log.Fatal(err)
 	}
-	c := client.New(o)
+	go logStats(c)
 	log.Error(c.ListenAndServe())
 }
+
+func logStats(c *client.Client) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		log.Infof("tls handshakes, %s", c.HandshakeStats())
+		if c.Pool != nil {
+			log.Infof("pool, %s", c.Pool.Stats())
+		}
+	}
+}
@@ -2,44 +2,132 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/iberryful/sproxy/pkg/log"
+	"github.com/iberryful/sproxy/pkg/pipe"
 	"github.com/iberryful/sproxy/pkg/server"
+	"github.com/iberryful/sproxy/pkg/transport"
 	"github.com/pkg/profile"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	listenAddr    string
 	logLevel      string
 	secret        string
+	users         string
 	key           string
 	crt           string
 	enableProfile bool
+	window        uint
+	clientCA      string
+	crl           string
+	fallback      string
+	maxFrame      int
+	grace         time.Duration
+	transportName string
+	path          string
+	camoPath      string
+	camoHost      string
+	sniCerts      keyPairFlag
 )
 
+// keyPairFlag collects the "cert,key" pairs of repeated flags.
+type keyPairFlag []server.KeyPair
+
+func (f *keyPairFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *keyPairFlag) Set(s string) error {
+	i := strings.Index(s, ",")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("invalid certificate %q, expected cert,key", s)
+	}
+	*f = append(*f, server.KeyPair{CrtPath: s[:i], KeyPath: s[i+1:]})
+	return nil
+}
+
 func init() {
 	flag.StringVar(&listenAddr, "l", "127.0.0.1:7443", "listen address")
-	flag.StringVar(&secret, "s", "secret", "secret")
+	flag.StringVar(&secret, "s", "secret", "secret, not checked with mutual TLS, client certificates replace it")
+	flag.StringVar(&users, "u", "", "users file with a user ID and secret per line, reloaded on SIGHUP")
 	flag.StringVar(&logLevel, "v", "info", "log level")
-	flag.StringVar(&key, "k", "examples/key.pem", "server private key")
-	flag.StringVar(&crt, "c", "examples/cert.pem", "server certificate")
+	flag.StringVar(&key, "k", "", "server private key, reloaded on SIGHUP or change")
+	flag.StringVar(&crt, "c", "", "server certificate, reloaded on SIGHUP or change, a self-signed one is generated if neither is set")
+	flag.Var(&sniCerts, "sni-cert", "certificate and key as cert,key selected by the SNI of clients, repeated for each domain")
 	flag.BoolVar(&enableProfile, "p", false, "enable profile")
+	flag.UintVar(&window, "w", 256*1024, "initial receive window of a multiplexed stream")
+	flag.StringVar(&clientCA, "ca", "", "client CA, enables mutual TLS")
+	flag.StringVar(&crl, "crl", "", "CRL of client certificates, reloaded on SIGHUP")
+	flag.StringVar(&fallback, "f", "", "fallback address for unauthenticated connections, such as a local web server")
+	flag.IntVar(&maxFrame, "frame", 0, "largest frame payload clients may negotiate, 0 for 1 MiB")
+	flag.DurationVar(&grace, "grace", server.DefaultGracePeriod, "time given to active connections to finish on SIGTERM")
+	flag.StringVar(&transportName, "transport", "tls", "transport of pipes: tls, tcp, ws, wss or h2")
+	flag.StringVar(&path, "path", "/", "request path of the ws, wss and h2 transports, other requests go to the fallback")
+	flag.StringVar(&camoPath, "camo-path", "", "path of the HTTP/1.1 request expected first on connections, enables the camouflage")
+	flag.StringVar(&camoHost, "camo-host", "", "Host header of the camouflage request, any by default")
 	flag.Parse()
 	log.SetLevel(logLevel)
 }
 
 func main() {
+	if maxFrame != 0 && (maxFrame < pipe.MinFrameSize || maxFrame > pipe.MaxFrameLimit) {
+		log.Fatalf("frame size must be between %d and %d", pipe.MinFrameSize, pipe.MaxFrameLimit)
+	}
 	if enableProfile {
 		defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
 	}
 	o := &server.ServerOption{
-		KeyPath: key,
-		CrtPath: crt,
-		Secret:  secret,
-		Listen:  listenAddr,
+		KeyPath:      key,
+		CrtPath:      crt,
+		Certificates: sniCerts,
+		Secret:       secret,
+		UsersPath:    users,
+		Listen:       listenAddr,
+		Window:       uint32(window),
+		ClientCAPath: clientCA,
+		CRLPath:      crl,
+		Fallback:     fallback,
+		MaxFrameSize: maxFrame,
+		GracePeriod:  grace,
+		Transport:    transportName,
+		Path:         path,
+	}
+	if camoPath != "" {
+		o.Camouflage = &transport.Camouflage{Path: camoPath, Host: camoHost}
 	}
 	s, err := server.NewServer(o)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Error(s.Start())
+	go reload(s)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start()
+	}()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		log.Error(err)
+	case <-ch:
+		log.Info("SIGTERM received, shutting down")
+		s.Shutdown()
+	}
+}
+
+func reload(s *server.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := s.Reload(); err != nil {
+			log.Error(err)
+		}
+	}
 }
@@ -1,9 +1,11 @@
 module github.com/iberryful/sproxy
 
-go 1.13
+go 1.25.0
 
 require (
 	github.com/gxlog/gxlog v0.7.0
 	github.com/pkg/profile v1.5.0
-	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	golang.org/x/net v0.53.0
 )
+
+require golang.org/x/text v0.36.0 // indirect
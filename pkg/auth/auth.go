@@ -0,0 +1,93 @@
+// Package auth looks up the secrets used to authenticate pipe handshakes.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Keys looks up the secret of a user.
+type Keys interface {
+	Secret(user string) (string, bool)
+}
+
+// Secret is a single secret shared by every user.
+type Secret string
+
+func (s Secret) Secret(user string) (string, bool) {
+	return string(s), true
+}
+
+// Users holds per-user secrets loaded from a file. Each line of the file is
+// a user ID and its secret separated by spaces, empty lines and lines
+// starting with # are ignored.
+type Users struct {
+	mu      sync.RWMutex
+	path    string
+	secrets map[string]string
+}
+
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload reads the file again, the current users are kept on error.
+func (u *Users) Reload() error {
+	b, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		return fmt.Errorf("error loading users, %v", err)
+	}
+	secrets, err := parseUsers(b)
+	if err != nil {
+		return fmt.Errorf("error loading users from %s, %v", u.path, err)
+	}
+
+	u.mu.Lock()
+	u.secrets = secrets
+	u.mu.Unlock()
+	return nil
+}
+
+func (u *Users) Secret(user string) (string, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	secret, ok := u.secrets[user]
+	return secret, ok
+}
+
+func (u *Users) Len() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.secrets)
+}
+
+func parseUsers(b []byte) (map[string]string, error) {
+	secrets := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expect user and secret", n)
+		}
+		if len(fields[0]) > 255 {
+			return nil, fmt.Errorf("line %d: user ID too long", n)
+		}
+		if _, ok := secrets[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicated user %s", n, fields[0])
+		}
+		secrets[fields[0]] = fields[1]
+	}
+	return secrets, s.Err()
+}
@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+)
+
+// PinPrefix is the optional prefix of a public key pin, as used by curl.
+const PinPrefix = "sha256//"
+
+// PublicKeyPin returns the base64 encoded SHA-256 of the SubjectPublicKeyInfo
+// of cert.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParsePin validates pin and strips its optional prefix.
+func ParsePin(pin string) (string, bool) {
+	pin = strings.TrimPrefix(pin, PinPrefix)
+	b, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(b) != sha256.Size {
+		return "", false
+	}
+	return pin, true
+}
@@ -1,14 +1,16 @@
 package client
 
 import (
-	"crypto/tls"
+	"fmt"
 	"github.com/iberryful/sproxy/pkg/log"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/iberryful/sproxy/pkg/pipe"
 	"github.com/iberryful/sproxy/pkg/socks"
+	"github.com/iberryful/sproxy/pkg/transport"
 )
 
 type RemoteConn struct {
@@ -19,28 +21,110 @@ type RemoteConn struct {
 type ClientOption struct {
 	ListenAddr string
 	RemoteAddr string
+	User       string
 	Secret     string
 	PoolSize   int
 	Timeout    time.Duration
+	Mux        bool
+	Window     uint32
+	// CAPath is a PEM bundle of CAs the server certificate must chain to.
+	CAPath string
+	// ServerName is the SNI sent and verified, the host of RemoteAddr by default.
+	ServerName string
+	// PinSHA256 is the base64 SHA-256 of the server public key.
+	PinSHA256 string
+	// CertPath and KeyPath are the client certificate presented to servers
+	// requiring mutual TLS.
+	CertPath string
+	KeyPath  string
+	// Padding is requested at handshake to hide the length of frames.
+	Padding pipe.PaddingMode
+	// Compress lists the compression algorithms requested in order of
+	// preference, it does not apply to multiplexed pipes.
+	Compress []pipe.Compression
+	// MaxFrameSize is the largest frame payload requested, up to
+	// pipe.MaxFrameLimit. Larger frames trade latency for throughput, 0
+	// keeps the default.
+	MaxFrameSize int
+	// PingTimeout is how long an idle pipe has to answer a ping before it
+	// is evicted from the pool, 0 means pipe.DefaultPingTimeout.
+	PingTimeout time.Duration
+	// CoverInterval is the mean interval of cover pings sent on idle pipes,
+	// 0 disables them.
+	CoverInterval time.Duration
+	// Resume keeps connections alive across the loss of their pipe, by
+	// dialing the server again and replaying unacknowledged data. It does
+	// not apply to multiplexed pipes.
+	Resume bool
+	// Transport is the name of the transport pipes are dialed with, see
+	// package transport, "" means TLS.
+	Transport string
+	// Path and Host are the request path and Host header of HTTP based
+	// transports, "/" and RemoteAddr by default.
+	Path string
+	Host string
+	// Camouflage, if set, is the HTTP/1.1 exchange starting connections,
+	// before the frames of their pipe.
+	Camouflage *transport.Camouflage
+	// MaxInFlight bounds the pipes of the pool used at once, connections
+	// beyond it wait for a pipe, and fail after pipe.DefaultWaitTimeout. 0
+	// means no bound.
+	MaxInFlight int
 }
 
+// maxSessionStreams is the number of streams sharing one session before
+// another session is dialed.
+const maxSessionStreams = 128
+
+// maxGoAwayRetries is how many times a connection refused by a server going
+// away is retried on another pipe or session.
+const maxGoAwayRetries = 3
+
 type Client struct {
 	Option      *ClientOption
 	Pool        *pipe.Pool
 	activeCount int64
+	mu          sync.Mutex
+	sessions    []*pipe.Session
+	transport   transport.Transport
+	statsMu     sync.Mutex
+	handshakes  HandshakeStats
 }
 
-func New(o *ClientOption) *Client {
+func New(o *ClientOption) (*Client, error) {
+	conf, err := tlsConfig(o)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client, %v", err)
+	}
+	t, err := transport.New(o.Transport, &transport.Config{
+		TLS:  conf,
+		Path: o.Path,
+		Host: o.Host,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating client, %v", err)
+	}
 	c := &Client{
-		Option: o,
+		Option:    o,
+		transport: t,
+	}
+	if !o.Mux {
+		c.Pool = pipe.NewPool(o.PoolSize, c.Option.Timeout, c.Dial)
+		if o.PingTimeout > 0 {
+			c.Pool.PingTimeout = o.PingTimeout
+		}
+		c.Pool.MaxInFlight = o.MaxInFlight
 	}
-	c.Pool = pipe.NewPool(o.PoolSize, c.Option.Timeout, c.Dial)
-	return c
+	return c, nil
 }
 
 func (c *Client) ListenAndServe() error {
 	log.Infof("listening at %s", c.Option.ListenAddr)
-	log.Infof("Pool size: %d, timeout: %s", c.Option.PoolSize, c.Option.Timeout)
+	if c.Option.Mux {
+		log.Infof("Multiplexing enabled, timeout: %s", c.Option.Timeout)
+	} else {
+		log.Infof("Pool size: %d, timeout: %s", c.Option.PoolSize, c.Option.Timeout)
+	}
 	l, err := net.Listen("tcp", c.Option.ListenAddr)
 	if err != nil {
 		return err
@@ -59,34 +143,53 @@ func (c *Client) ListenAndServe() error {
 func (c *Client) handleConn(conn net.Conn) error {
 	defer conn.Close()
 	t := time.Now()
-	addr, err := socks.Handshake(conn)
+	// the reply is delayed until the remote confirms the connection
+	addr, err := socks.ReadRequest(conn)
 	if err != nil {
 		log.Error(err)
 		return nil
 	}
 
+	if c.Option.Mux {
+		return c.handleStream(conn, addr, t)
+	}
+
 	var p *pipe.Pipe
 
-	for {
+	for i := 0; ; i++ {
+		// pipes failing to answer a ping are evicted by Get
 		p, err = c.Pool.Get()
 		if err != nil {
+			log.Warnf("error creating pipe, %s", err)
+			socks.Reply(conn, err)
 			return err
 		}
-		err = p.TryPing()
-		if err != nil {
-			log.Warnf("[%s] ping failed, %s", p, err)
-			p.Close()
-			continue
+
+		err = p.HandShake(addr, c.Option.User, c.Option.Secret)
+		if err == nil {
+			err = p.WaitForReply()
 		}
-		break
+		// the server is shutting down, the connection is retried on another pipe
+		if err == nil || !p.Draining() || i == maxGoAwayRetries {
+			break
+		}
+		log.Infof("[%s] connection %s refused by a server going away, %s", p, addr, err)
+		c.Pool.Discard(p)
+	}
+	if e, ok := err.(socks.Error); ok {
+		log.Infof("[%s] [pool: %2d] connection %s rejected, %s", p, c.Pool.Len(), addr, e)
+		socks.Reply(conn, e)
+		c.Pool.Put(p)
+		return nil
 	}
-
-	err = p.HandShake(addr, c.Option.Secret)
 	if err != nil {
 		log.Warnf("[%s] error handshake, %s", p, err)
-		p.Close()
+		socks.Reply(conn, err)
+		c.Pool.Discard(p)
 		return nil
 	}
+	// a failed reply is noticed by Bind, which also tears down the remote
+	socks.Reply(conn, nil)
 
 	atomic.AddInt64(&c.activeCount, 1)
 	log.Infof("[%s] [conn: %2d] [pool: %2d] handle conn: %s, handshake time: %d ms", p, c.activeCount, c.Pool.Len(), addr, time.Now().Sub(t).Milliseconds())
@@ -98,19 +201,135 @@ func (c *Client) handleConn(conn net.Conn) error {
 		return nil
 	}
 
-	p.Close()
+	c.Pool.Discard(p)
 	log.Infof("[%s] [conn: %2d] [pool: %2d] %s closed", p, c.activeCount, c.Pool.Len(), addr)
 	return nil
 }
 
+func (c *Client) handleStream(conn net.Conn, addr socks.Addr, t time.Time) error {
+	var sess *pipe.Session
+	var st *pipe.Stream
+	var err error
+	for i := 0; ; i++ {
+		sess, err = c.session()
+		if err != nil {
+			log.Warnf("error creating session, %s", err)
+			socks.Reply(conn, err)
+			return err
+		}
+
+		st, err = sess.Open(addr, c.Option.User, c.Option.Secret)
+		if err == nil {
+			err = st.WaitForReply()
+		}
+		// the server is shutting down, the stream is retried on another session
+		if err == nil || !sess.Draining() || i == maxGoAwayRetries {
+			break
+		}
+		log.Infof("[%s] connection %s refused by a server going away, %s", sess, addr, err)
+	}
+	if e, ok := err.(socks.Error); ok {
+		log.Infof("[%s] [streams: %2d] connection %s rejected, %s", st, sess.NumStreams(), addr, e)
+		socks.Reply(conn, e)
+		return nil
+	}
+	if err != nil {
+		log.Warnf("[%s] error open stream, %s", sess, err)
+		socks.Reply(conn, err)
+		return nil
+	}
+	socks.Reply(conn, nil)
+
+	n := atomic.AddInt64(&c.activeCount, 1)
+	log.Infof("[%s] [conn: %2d] [streams: %2d] handle conn: %s, handshake time: %d ms", st, n, sess.NumStreams(), addr, time.Now().Sub(t).Milliseconds())
+	st.Bind(conn)
+	n = atomic.AddInt64(&c.activeCount, -1)
+	log.Infof("[%s] [conn: %2d] [streams: %2d] %s closed", st, n, sess.NumStreams(), addr)
+	return nil
+}
+
+// session returns the least loaded session, a new one is dialed when all
+// of them are busy.
+func (c *Client) session() (*pipe.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var best *pipe.Session
+	live := c.sessions[:0]
+	for _, sess := range c.sessions {
+		if sess.IsClosed() {
+			continue
+		}
+		// sessions the server is going away from are closed once idle
+		if sess.Draining() {
+			if sess.NumStreams() == 0 {
+				sess.Close()
+				continue
+			}
+			live = append(live, sess)
+			continue
+		}
+		live = append(live, sess)
+		if best == nil || sess.NumStreams() < best.NumStreams() {
+			best = sess
+		}
+	}
+	c.sessions = live
+
+	if best != nil && best.NumStreams() < maxSessionStreams {
+		return best, nil
+	}
+
+	p, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := pipe.NewClientSession(p, c.Option.User, c.Option.Secret, c.Option.Window)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	c.sessions = append(c.sessions, sess)
+	return sess, nil
+}
+
 func (c *Client) Dial() (*pipe.Pipe, error) {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
+	r, err := c.dial()
+	if err != nil {
+		return nil, err
 	}
-	r, err := tls.Dial("tcp", c.Option.RemoteAddr, conf)
+	p := pipe.New(r, c.Option.Timeout)
+	p.SetFeatures(pipe.Features{
+		Padding:  c.Option.Padding,
+		Compress: c.Option.Compress,
+		MaxFrame: c.Option.MaxFrameSize,
+		Resume:   c.Option.Resume,
+	})
+	if c.Option.Resume {
+		p.SetRedial(c.dial)
+	}
+	if c.Option.CoverInterval > 0 {
+		p.StartCover(c.Option.CoverInterval)
+	}
+	return p, nil
+}
 
+// dial dials the remote with the transport, then runs the camouflage
+// exchange if any.
+func (c *Client) dial() (net.Conn, error) {
+	t := time.Now()
+	conn, err := c.transport.Dial(c.Option.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.recordHandshake(conn, time.Since(t))
+	if c.Option.Camouflage == nil {
+		return conn, nil
+	}
+	r, err := c.Option.Camouflage.Client(conn, c.Option.RemoteAddr)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return pipe.New(r, c.Option.Timeout), nil
+	return r, nil
 }
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// HandshakeStats counts the TLS handshakes of the connections dialed for
+// pipes, with their total durations, connecting included. Resumed
+// handshakes reuse a session of the client session cache.
+type HandshakeStats struct {
+	Full        int64
+	Resumed     int64
+	FullTime    time.Duration
+	ResumedTime time.Duration
+}
+
+func (s HandshakeStats) String() string {
+	return fmt.Sprintf("full: %d, avg %s, resumed: %d, avg %s",
+		s.Full, avg(s.FullTime, s.Full), s.Resumed, avg(s.ResumedTime, s.Resumed))
+}
+
+func avg(d time.Duration, n int64) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	return (d / time.Duration(n)).Round(time.Microsecond)
+}
+
+// HandshakeStats returns the handshakes of the pipes dialed so far.
+func (c *Client) HandshakeStats() HandshakeStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.handshakes
+}
+
+// recordHandshake counts the handshake of conn dialed in d, through the
+// TLS state exposed by the connections of the tls, wss and h2 transports.
+// Connections without TLS, and h2 streams opened on a TLS connection
+// dialed before, are not counted.
+func (c *Client) recordHandshake(conn net.Conn, d time.Duration) {
+	tc, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return
+	}
+	if r, ok := conn.(interface{ Reused() bool }); ok && r.Reused() {
+		return
+	}
+	state := tc.ConnectionState()
+	if !state.HandshakeComplete {
+		return
+	}
+
+	c.statsMu.Lock()
+	if state.DidResume {
+		c.handshakes.Resumed += 1
+		c.handshakes.ResumedTime += d
+	} else {
+		c.handshakes.Full += 1
+		c.handshakes.FullTime += d
+	}
+	stats := c.handshakes
+	c.statsMu.Unlock()
+	log.Debugf("dialed %s in %d ms, session resumed: %v, %s", c.Option.RemoteAddr, d.Milliseconds(), state.DidResume, stats)
+}
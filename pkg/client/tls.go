@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// tlsConfig builds the config used to dial the remote. The server
+// certificate is verified against CAPath if set, and its public key must
+// match PinSHA256 if set. Without either, the certificate is not verified.
+func tlsConfig(o *ClientOption) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: o.ServerName,
+		// shared by the pipes, new ones resume the sessions of others
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if o.CAPath != "" {
+		b, err := ioutil.ReadFile(o.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CA, %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("error loading CA, no certificate found in %s", o.CAPath)
+		}
+		conf.RootCAs = roots
+	} else {
+		// verified by the pin below, or not at all
+		conf.InsecureSkipVerify = true
+	}
+
+	if o.PinSHA256 != "" {
+		pin, ok := auth.ParsePin(o.PinSHA256)
+		if !ok {
+			return nil, fmt.Errorf("invalid public key pin %q", o.PinSHA256)
+		}
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(rawCerts, pin)
+		}
+	}
+
+	if o.CertPath != "" || o.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertPath, o.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate, %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.CAPath == "" && o.PinSHA256 == "" {
+		log.Warn("neither CA nor public key pin is set, the server certificate is not verified")
+	}
+	return conf, nil
+}
+
+func verifyPin(rawCerts [][]byte, pin string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("error parsing server certificate, %v", err)
+	}
+	if got := auth.PublicKeyPin(cert); got != pin {
+		return fmt.Errorf("server public key pin mismatch, expect %s, got %s", pin, got)
+	}
+	return nil
+}
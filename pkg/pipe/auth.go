@@ -0,0 +1,246 @@
+package pipe
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+// The payload of a CmdConn or CmdMux frame is
+// version | timestamp | nonce | user length | user | options length | options | addr | mac
+// where mac is HMAC-SHA256 keyed by the secret of the user over the frame
+// header, everything before it and the channel binding of the pipe. The addr
+// of a CmdMux or CmdResume frame is empty. The version is never a SOCKS
+// address type, the first payload byte of the unversioned CmdConn, so that
+// legacy handshakes fail with ErrVersion.
+const ProtocolVersion uint8 = 5
+const TimestampLen int = 8
+const NonceLen int = 16
+const MacLen int = sha256.Size
+const handShakeFixedLen = 1 + TimestampLen + NonceLen + 1 + 1 + MacLen
+
+// ExporterLabel is the label of the keying material exported from the TLS
+// session as channel binding. A MITM terminating TLS holds a different
+// session, so its relayed handshakes fail even if certificates are not
+// verified.
+const ExporterLabel = "EXPORTER-sproxy-channel-binding"
+const BindingLen = 32
+
+// MaxClockSkew is the maximum difference allowed between the timestamp of a
+// handshake and the local clock.
+const MaxClockSkew = 2 * time.Minute
+
+// DefaultNonceCacheSize is the number of recent nonces a server remembers.
+const DefaultNonceCacheSize = 64 * 1024
+
+var ErrHandShake = errors.New("invalid handshake")
+var ErrVersion = errors.New("unsupported protocol version")
+var ErrAuth = errors.New("invalid handshake hmac")
+var ErrStale = errors.New("stale handshake")
+var ErrReplay = errors.New("replayed handshake")
+
+// maxFieldLen is the longest user ID or options a handshake carries, their
+// length is a single byte.
+const maxFieldLen = 0xff
+
+// handShake is a verified CmdConn, CmdMux or CmdResume.
+type handShake struct {
+	addr    socks.Addr
+	user    string
+	options []byte
+}
+
+// handShakeFrame builds a CmdConn frame (without magic) requesting addr, or
+// a CmdMux frame, authenticated by the secret of user and bound to the
+// channel. User IDs and options longer than 255 bytes are rejected.
+func handShakeFrame(cmd, term uint8, addr socks.Addr, user, secret string, options, binding []byte) ([]byte, error) {
+	if len(user) > maxFieldLen {
+		return nil, fmt.Errorf("%w, user too long: %d bytes", ErrHandShake, len(user))
+	}
+	if len(options) > maxFieldLen {
+		return nil, fmt.Errorf("%w, options too long: %d bytes", ErrHandShake, len(options))
+	}
+	length := handShakeFixedLen + len(user) + len(options) + len(addr)
+	buf := make([]byte, HeaderLen+length)
+	buf[0] = cmd
+	buf[1] = term
+	binary.BigEndian.PutUint16(buf[2:], uint16(length))
+
+	b := buf[HeaderLen:]
+	b[0] = ProtocolVersion
+	binary.BigEndian.PutUint64(b[1:], uint64(time.Now().Unix()))
+	if _, err := rand.Read(b[1+TimestampLen : 1+TimestampLen+NonceLen]); err != nil {
+		return nil, fmt.Errorf("error creating nonce, %v", err)
+	}
+	pos := 1 + TimestampLen + NonceLen
+	b[pos] = uint8(len(user))
+	pos += 1 + copy(b[pos+1:], user)
+	b[pos] = uint8(len(options))
+	pos += 1 + copy(b[pos+1:], options)
+	copy(b[pos:], addr)
+
+	n := len(buf) - MacLen
+	copy(buf[n:], handShakeMac(buf[:n], secret, binding))
+	return buf, nil
+}
+
+// verifyHandShake checks a CmdConn or CmdMux frame (without magic) against
+// the secret of the user it claims and the channel binding. With nil keys
+// the mac is not checked, the client being authenticated by its TLS
+// certificate. The nonce is recorded in nonces to reject replays. The user
+// is returned even if the check fails.
+func verifyHandShake(buf []byte, keys auth.Keys, nonces *NonceCache, binding []byte) (handShake, error) {
+	var hs handShake
+	// the version comes first, handshakes of other versions have other
+	// lengths
+	if len(buf) > HeaderLen && buf[HeaderLen] != ProtocolVersion {
+		return hs, fmt.Errorf("%w, expect %d, got %d", ErrVersion, ProtocolVersion, buf[HeaderLen])
+	}
+	if len(buf) < HeaderLen+handShakeFixedLen {
+		return hs, fmt.Errorf("%w, length: %d", ErrHandShake, len(buf))
+	}
+
+	b := buf[HeaderLen:]
+
+	pos := 1 + TimestampLen + NonceLen
+	userLen := int(b[pos])
+	if len(b) < handShakeFixedLen+userLen {
+		return hs, fmt.Errorf("%w, user length: %d", ErrHandShake, userLen)
+	}
+	hs.user = string(b[pos+1 : pos+1+userLen])
+	pos += 1 + userLen
+	optLen := int(b[pos])
+	if len(b) < handShakeFixedLen+userLen+optLen {
+		return hs, fmt.Errorf("%w, options length: %d", ErrHandShake, optLen)
+	}
+	hs.options = b[pos+1 : pos+1+optLen]
+	pos += 1 + optLen
+
+	if keys != nil {
+		secret, ok := keys.Secret(hs.user)
+		if !ok {
+			return hs, fmt.Errorf("%w, unknown user %q", ErrAuth, hs.user)
+		}
+		n := len(buf) - MacLen
+		if !hmac.Equal(handShakeMac(buf[:n], secret, binding), buf[n:]) {
+			return hs, ErrAuth
+		}
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b[1:])), 0)
+	if d := time.Since(ts); d > MaxClockSkew || d < -MaxClockSkew {
+		return hs, fmt.Errorf("%w, timestamp: %s", ErrStale, ts)
+	}
+
+	rawAddr := b[pos : len(b)-MacLen]
+	hs.addr = socks.SplitAddr(rawAddr)
+	if buf[0] == CmdMux || buf[0] == CmdResume {
+		hs.addr = rawAddr
+	}
+	if len(hs.addr) != len(rawAddr) || (buf[0] == CmdConn && hs.addr == nil) {
+		return hs, fmt.Errorf("%w, addr: %x", ErrHandShake, rawAddr)
+	}
+
+	if nonces != nil && !nonces.Add(b[1+TimestampLen:1+TimestampLen+NonceLen]) {
+		return hs, ErrReplay
+	}
+	return hs, nil
+}
+
+// IsAuthError reports whether err is caused by a peer failing the magic or
+// handshake check, or sending a malformed frame, rather than by the
+// connection.
+func IsAuthError(err error) bool {
+	var fe *FrameError
+	if errors.As(err, &fe) {
+		return true
+	}
+	for _, e := range []error{ErrMagic, ErrHandShake, ErrVersion, ErrAuth, ErrStale, ErrReplay} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func handShakeMac(msg []byte, secret string, binding []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(msg)
+	h.Write(binding)
+	return h.Sum(nil)
+}
+
+// channelBinding returns the keying material exported from the TLS session
+// of conn, or nil if conn is not a TLS connection.
+func channelBinding(conn net.Conn) ([]byte, error) {
+	c, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil, nil
+	}
+	state := c.ConnectionState()
+	// wrappers of non TLS connections return the zero state
+	if state.Version == 0 && !state.HandshakeComplete {
+		return nil, nil
+	}
+	if !state.HandshakeComplete {
+		return nil, errors.New("channel binding: tls handshake not complete")
+	}
+	b, err := state.ExportKeyingMaterial(ExporterLabel, nil, BindingLen)
+	if err != nil {
+		return nil, fmt.Errorf("channel binding: %v", err)
+	}
+	return b, nil
+}
+
+// NonceCache remembers the most recent nonces seen by a server. Handshakes
+// older than MaxClockSkew are rejected anyway, so only the size is bounded.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[[NonceLen]byte]struct{}
+	ring [][NonceLen]byte
+	pos  int
+}
+
+func NewNonceCache(size int) *NonceCache {
+	if size <= 0 {
+		size = DefaultNonceCacheSize
+	}
+	return &NonceCache{
+		seen: make(map[[NonceLen]byte]struct{}, size),
+		ring: make([][NonceLen]byte, 0, size),
+	}
+}
+
+// Add records nonce, it returns false if nonce has been seen before.
+func (c *NonceCache) Add(nonce []byte) bool {
+	var k [NonceLen]byte
+	copy(k[:], nonce)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[k]; ok {
+		return false
+	}
+
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, k)
+	} else {
+		delete(c.seen, c.ring[c.pos])
+		c.ring[c.pos] = k
+		c.pos = (c.pos + 1) % len(c.ring)
+	}
+	c.seen[k] = struct{}{}
+	return true
+}
@@ -0,0 +1,77 @@
+package pipe
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+func TestHandShakeFrame(t *testing.T) {
+	addr := socks.ParseAddr("example.com:443")
+	buf, err := handShakeFrame(CmdConn, 1, addr, "alice", "secret", nil, []byte("binding"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := verifyHandShake(buf, auth.Secret("secret"), NewNonceCache(0), []byte("binding"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.user != "alice" || hs.addr.String() != addr.String() {
+		t.Fatalf("got user %q, addr %s", hs.user, hs.addr)
+	}
+
+	if _, err := verifyHandShake(buf, auth.Secret("secret"), nil, []byte("other")); !errors.Is(err, ErrAuth) {
+		t.Fatalf("handshake verified with another channel binding, %v", err)
+	}
+}
+
+func TestHandShakeFrameLongUser(t *testing.T) {
+	if _, err := handShakeFrame(CmdConn, 0, nil, strings.Repeat("u", 255), "secret", nil, nil); err != nil {
+		t.Fatalf("255 bytes user rejected, %v", err)
+	}
+	if _, err := handShakeFrame(CmdConn, 0, nil, strings.Repeat("u", 256), "secret", nil, nil); !errors.Is(err, ErrHandShake) {
+		t.Fatalf("256 bytes user accepted, %v", err)
+	}
+	if _, err := handShakeFrame(CmdMux, 0, nil, "alice", "secret", make([]byte, 256), nil); !errors.Is(err, ErrHandShake) {
+		t.Fatalf("256 bytes options accepted, %v", err)
+	}
+}
+
+func TestVerifyHandShakeWithoutKeys(t *testing.T) {
+	buf, err := handShakeFrame(CmdMux, 0, nil, "alice", "any", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyHandShake(buf, auth.Secret("secret"), nil, nil); !errors.Is(err, ErrAuth) {
+		t.Fatalf("handshake verified with another secret, %v", err)
+	}
+	if _, err := verifyHandShake(buf, nil, nil, nil); err != nil {
+		t.Fatalf("handshake not verified without keys, %v", err)
+	}
+}
+
+// legacyHandShake builds the CmdConn frame of clients predating versioned
+// handshakes, magic included.
+func legacyHandShake(addr socks.Addr, secret string) []byte {
+	buf := append([]byte{}, Magic...)
+	buf = append(buf, CmdConn, 0, 0, byte(len(addr)+sha256.Size))
+	buf = append(buf, addr...)
+	mac := sha256.Sum256(append(append([]byte{}, buf[MagicLen:]...), secret...))
+	return append(buf, mac[:]...)
+}
+
+func TestLegacyHandShake(t *testing.T) {
+	addrs := []string{"127.0.0.1:80", "[::1]:443", "a.io:80", "a-rather-long-domain-name.example.com:443"}
+	for _, addr := range addrs {
+		c, s := tcpPair(t)
+		go c.Write(legacyHandShake(socks.ParseAddr(addr), "secret"))
+		_, _, err := New(s, 0).WaitForHandShake(auth.Secret("secret"), nil)
+		if !errors.Is(err, ErrVersion) || !IsAuthError(err) {
+			t.Fatalf("legacy handshake for %s, got %v, want %v", addr, err, ErrVersion)
+		}
+	}
+}
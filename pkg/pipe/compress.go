@@ -0,0 +1,151 @@
+package pipe
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// FlagCompressed marks a CmdTrans frame whose payload is a chunk of the
+// compressed stream of the term. Each chunk ends at a flush point, so the
+// remote can decompress everything received so far.
+const FlagCompressed = 0x40
+
+type Compression uint8
+
+const (
+	CompressNone    Compression = iota // 0
+	CompressDeflate                    // 1, DEFLATE of compress/flate
+)
+
+// ParseCompression parses a comma separated list of algorithms in order of
+// preference.
+func ParseCompression(s string) ([]Compression, error) {
+	var list []Compression
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "deflate":
+			list = append(list, CompressDeflate)
+		default:
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+	}
+	return list, nil
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressDeflate:
+		return "deflate"
+	}
+	return "none"
+}
+
+// CompressionStats counts the CmdTrans payload of a pipe before and after
+// compression, only compressed frames are counted.
+type CompressionStats struct {
+	RawOut        uint64
+	CompressedOut uint64
+	RawIn         uint64
+	CompressedIn  uint64
+}
+
+func (p *Pipe) CompressionStats() CompressionStats {
+	return CompressionStats{
+		RawOut:        atomic.LoadUint64(&p.stats.RawOut),
+		CompressedOut: atomic.LoadUint64(&p.stats.CompressedOut),
+		RawIn:         atomic.LoadUint64(&p.stats.RawIn),
+		CompressedIn:  atomic.LoadUint64(&p.stats.CompressedIn),
+	}
+}
+
+// writeCompressedLocked compresses b into the stream of the term and writes
+// it as compressed CmdTrans frames, wmu required.
+func (p *Pipe) writeCompressedLocked(b []byte) (int, error) {
+	if p.zw == nil {
+		p.zw, _ = flate.NewWriter(&p.zbuf, flate.DefaultCompression)
+	}
+	p.zbuf.Reset()
+	if _, err := p.zw.Write(b); err != nil {
+		return 0, err
+	}
+	if err := p.zw.Flush(); err != nil {
+		return 0, err
+	}
+
+	out := p.zbuf.Bytes()
+	atomic.AddUint64(&p.stats.RawOut, uint64(len(b)))
+	atomic.AddUint64(&p.stats.CompressedOut, uint64(len(out)))
+	if _, err := p.sendLocked(FlagCompressed, out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// inflate reads from the decompressed stream of the term, it is started by
+// the first compressed frame of the term.
+func (p *Pipe) inflate(b []byte) (int, error) {
+	if !p.inflating {
+		src := compressedReader{p}
+		if p.zr == nil {
+			p.zr = flate.NewReader(src)
+		} else {
+			p.zr.(flate.Resetter).Reset(src, nil)
+		}
+		p.inflating = true
+	}
+	n, err := p.zr.Read(b)
+	atomic.AddUint64(&p.stats.RawIn, uint64(n))
+	return n, err
+}
+
+// resetCompression drops the compression state of the finished term.
+func (p *Pipe) resetCompression() {
+	p.inflating = false
+	p.wmu.Lock()
+	if p.zw != nil {
+		p.zw.Reset(&p.zbuf)
+	}
+	p.wmu.Unlock()
+}
+
+// compressedReader reads the payload of the compressed frames of a term.
+type compressedReader struct {
+	p *Pipe
+}
+
+func (r compressedReader) Read(b []byte) (int, error) {
+	p := r.p
+	for {
+		for p.n == 0 {
+			n, err := p.readFrame(b)
+			if err != nil {
+				return 0, err
+			}
+			if n > 0 {
+				return 0, fmt.Errorf("[%s] unexpected cmd in compressed stream: %d", p, b[0])
+			}
+			if !p.compressed {
+				return 0, fmt.Errorf("[%s] uncompressed frame in compressed stream", p)
+			}
+		}
+
+		n, err := p.conn.Read(b[:min(len(b), p.n)])
+		p.n -= n
+		p.received(n)
+		atomic.AddUint64(&p.stats.CompressedIn, uint64(n))
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		// flate must not see the loss of a resumable connection
+		if err == nil || !p.recoverRead(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
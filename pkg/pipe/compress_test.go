@@ -0,0 +1,157 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// textData returns n bytes of words, data that compresses well.
+func textData(n int) []byte {
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while pipes carry frames")
+	r := rand.New(rand.NewSource(int64(n)))
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[r.Intn(len(words))])
+		b.WriteByte(' ')
+	}
+	return b.Bytes()[:n]
+}
+
+// compressedPair returns both ends of a term over TCP, the writes of a are
+// compressed.
+func compressedPair(t *testing.T) (a, b *Pipe) {
+	c, s := tcpPair(t)
+	a, b = New(c, 0), New(s, 0)
+	a.grant(PadNone, CompressDeflate, 0)
+	return a, b
+}
+
+// readAll reads p until it fails, it returns what was read and the error.
+func readAll(p *Pipe) ([]byte, error) {
+	var got []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			return got, err
+		}
+	}
+}
+
+func TestCompressTerms(t *testing.T) {
+	a, b := compressedPair(t)
+	// the same data in each term, it would refer to the previous terms if
+	// the compressor was not reset
+	data := textData(256 * 1024)
+	for i := 0; i < 3; i++ {
+		go func() {
+			a.Write(data)
+			a.TryInterruptRemote()
+		}()
+		got, err := readAll(b)
+		if err != ErrInterrupted {
+			t.Fatalf("term %d, %v", i, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("term %d, read %d bytes, data mismatch", i, len(got))
+		}
+		a.reset()
+		b.reset()
+	}
+	st := a.CompressionStats()
+	if st.RawOut != 3*uint64(len(data)) || st.CompressedOut >= st.RawOut/2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if in := b.CompressionStats(); in.RawIn != st.RawOut || in.CompressedIn != st.CompressedOut {
+		t.Fatalf("stats out %+v, in %+v", st, in)
+	}
+}
+
+func TestCompressInterruptedChunk(t *testing.T) {
+	a, b := compressedPair(t)
+	data, rest := textData(64*1024), textData(32*1024)
+	go func() {
+		a.Write(data)
+		// only half of the chunk of rest is sent before CmdClose
+		a.wmu.Lock()
+		a.zbuf.Reset()
+		a.zw.Write(rest)
+		a.zw.Flush()
+		chunk := a.zbuf.Bytes()
+		a.sendLocked(FlagCompressed, chunk[:len(chunk)/2])
+		a.wmu.Unlock()
+		a.TryInterruptRemote()
+	}()
+	got, err := readAll(b)
+	if err != ErrInterrupted {
+		t.Fatalf("expect ErrInterrupted, got %v", err)
+	}
+	if !bytes.HasPrefix(got, data) || !bytes.HasPrefix(rest, got[len(data):]) {
+		t.Fatalf("read %d bytes, data mismatch", len(got))
+	}
+	a.reset()
+	b.reset()
+
+	go a.Write(data)
+	got = make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch after the interrupted term")
+	}
+}
+
+func TestCompressMixedFrames(t *testing.T) {
+	c, s := tcpPair(t)
+	a, b := New(c, 0), New(s, 0)
+	raw, data := randomData(16*1024), textData(64*1024)
+
+	// uncompressed frames may precede the compressed stream of a term, the
+	// reader follows FlagCompressed whatever it was granted
+	go func() {
+		a.Write(raw)
+		a.grant(PadNone, CompressDeflate, 0)
+		a.Write(data)
+		a.grant(PadNone, CompressNone, 0)
+		a.Write(raw)
+	}()
+	got := make([]byte, len(raw)+len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(raw)], raw) || !bytes.Equal(got[len(raw):], data) {
+		t.Fatal("data mismatch")
+	}
+
+	// but not follow it
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(got); err == nil || !strings.Contains(err.Error(), "uncompressed frame") {
+		t.Fatalf("uncompressed frame accepted in compressed stream, %v", err)
+	}
+}
+
+// TestCompressResume loses connections while compressed data goes both
+// ways, the compressed frames are replayed on the new ones.
+func TestCompressResume(t *testing.T) {
+	s := newResumeServer(t)
+	p := dialResumable(t, s, Features{Compress: []Compression{CompressDeflate}})
+	if p.compression != CompressDeflate {
+		t.Fatal("compression not granted")
+	}
+	data := textData(8 * 1024 * 1024)
+	read, errc := transfer(p, data)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		s.kill()
+	}
+	waitTransfer(t, read, errc, data)
+	if st := p.CompressionStats(); st.CompressedIn == 0 || st.RawIn != uint64(len(data)) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,275 @@
+package pipe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Options of a handshake and of its CmdOK reply are encoded as
+// type | length | value
+// unknown options are ignored, so that peers of different versions agree on
+// the features both of them support.
+const (
+	OptPadding     = 1
+	OptCompression = 2
+	OptMaxFrame    = 3
+	OptResume      = 4
+)
+
+// FlagPadded marks a frame followed by padding. The 2-byte padding length
+// follows the header, the padding follows the payload.
+const FlagPadded = 0x80
+const CmdMask = 0x1f
+const PadLenLen int = 2
+
+// FlagExtLen marks a frame longer than 64 KiB, the high 16 bits of its
+// length follow the header, before the padding length.
+const FlagExtLen = 0x20
+const ExtLenLen int = 2
+
+// MaxFrameLimit is the largest frame payload that can be negotiated,
+// MinFrameSize the smallest.
+const MaxFrameLimit = 1024 * 1024
+const MinFrameSize = 512
+
+// maxRandomPadding bounds the padding of PadRandom.
+const maxRandomPadding = 256
+
+var padBuckets = []int{256, 1024, 4096, bufSize + PadLenLen}
+
+type PaddingMode uint8
+
+const (
+	PadNone   PaddingMode = iota // 0
+	PadBucket                    // 1, frames are padded to the next size bucket
+	PadRandom                    // 2, frames are padded by a random length
+)
+
+func ParsePadding(s string) (PaddingMode, error) {
+	switch s {
+	case "", "none":
+		return PadNone, nil
+	case "bucket":
+		return PadBucket, nil
+	case "random":
+		return PadRandom, nil
+	}
+	return PadNone, fmt.Errorf("unknown padding mode %q", s)
+}
+
+func (m PaddingMode) String() string {
+	switch m {
+	case PadBucket:
+		return "bucket"
+	case PadRandom:
+		return "random"
+	}
+	return "none"
+}
+
+// Features are the optional protocol features a client requests at
+// handshake, the server grants the ones it supports in CmdOK. Compress lists
+// the algorithms requested in order of preference, compression is not
+// applied to multiplexed pipes. MaxFrame is the largest frame payload, the
+// server grants the smaller of the requested one and its own, 0 keeps the
+// default on the client and means MaxFrameLimit on the server. Resume makes
+// terms survive the loss of the connection, it requires SetRedial and is
+// not applied to multiplexed pipes.
+type Features struct {
+	Padding  PaddingMode
+	Compress []Compression
+	MaxFrame int
+	Resume   bool
+}
+
+// SetFeatures sets the features requested by the client side of p.
+func (p *Pipe) SetFeatures(f Features) {
+	p.features = f
+}
+
+// options encodes the features requested by the client.
+func (f Features) options() []byte {
+	var b []byte
+	if f.Padding != PadNone {
+		b = append(b, OptPadding, 1, byte(f.Padding))
+	}
+	if len(f.Compress) > 0 {
+		b = append(b, OptCompression, byte(len(f.Compress)))
+		for _, c := range f.Compress {
+			b = append(b, byte(c))
+		}
+	}
+	if f.MaxFrame > 0 {
+		b = append(b, OptMaxFrame, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(f.MaxFrame))
+	}
+	if f.Resume {
+		b = append(b, OptResume, 0)
+	}
+	return b
+}
+
+// acceptOptions is called by the server with the options of a CmdConn or
+// CmdMux, it enables the granted features and returns the options of the
+// reply.
+func (p *Pipe) acceptOptions(cmd uint8, b []byte) ([]byte, error) {
+	opts, err := parseOptions(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply []byte
+	padding := PadNone
+	if v, ok := opts[OptPadding]; ok && len(v) == 1 && v[0] <= uint8(PadRandom) {
+		padding = PaddingMode(v[0])
+		reply = append(reply, OptPadding, 1, v[0])
+	}
+	compression := CompressNone
+	if v, ok := opts[OptCompression]; ok && cmd == CmdConn {
+		for _, c := range v {
+			if Compression(c) == CompressDeflate {
+				compression = Compression(c)
+				reply = append(reply, OptCompression, 1, c)
+				break
+			}
+		}
+	}
+	maxFrame := 0
+	if v, ok := opts[OptMaxFrame]; ok && len(v) == 4 {
+		limit := p.features.MaxFrame
+		if limit == 0 {
+			limit = MaxFrameLimit
+		}
+		if n := min(int(binary.BigEndian.Uint32(v)), limit); n >= MinFrameSize {
+			maxFrame = n
+			reply = append(reply, OptMaxFrame, 4, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(reply[len(reply)-4:], uint32(n))
+		}
+	}
+	p.grant(padding, compression, maxFrame)
+	if _, ok := opts[OptResume]; ok && cmd == CmdConn {
+		reply = append(reply, p.grantResume()...)
+	}
+	return reply, nil
+}
+
+// applyOptions is called by the client with the options of CmdOK.
+func (p *Pipe) applyOptions(b []byte) error {
+	opts, err := parseOptions(b)
+	if err != nil {
+		return err
+	}
+
+	padding := PadNone
+	if v, ok := opts[OptPadding]; ok && len(v) == 1 && v[0] == uint8(p.features.Padding) {
+		padding = p.features.Padding
+	}
+	compression := CompressNone
+	if v, ok := opts[OptCompression]; ok && len(v) == 1 {
+		for _, c := range p.features.Compress {
+			if v[0] == uint8(c) {
+				compression = c
+			}
+		}
+	}
+	maxFrame := 0
+	if v, ok := opts[OptMaxFrame]; ok && len(v) == 4 {
+		n := int(binary.BigEndian.Uint32(v))
+		if n >= MinFrameSize && n <= p.features.MaxFrame {
+			maxFrame = n
+		}
+	}
+	p.grant(padding, compression, maxFrame)
+	if v, ok := opts[OptResume]; ok {
+		p.applyResume(v)
+	}
+	return nil
+}
+
+func parseOptions(b []byte) (map[uint8][]byte, error) {
+	opts := make(map[uint8][]byte)
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("%w, truncated option", ErrHandShake)
+		}
+		opts[b[0]] = b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+	}
+	return opts, nil
+}
+
+func (p *Pipe) grant(padding PaddingMode, compression Compression, maxFrame int) {
+	p.wmu.Lock()
+	p.padding = padding
+	p.compression = compression
+	p.maxFrame = maxFrame
+	p.wmu.Unlock()
+}
+
+// frameLen returns the largest frame payload granted, def if none is.
+func (p *Pipe) frameLen(def int) int {
+	if p.maxFrame > 0 {
+		return p.maxFrame
+	}
+	return def
+}
+
+// padLen returns the padding of a frame of n bytes, wmu required, or the
+// reader, which runs after the features are granted.
+func (p *Pipe) padLen(n int) int {
+	switch p.padding {
+	case PadBucket:
+		n += PadLenLen
+		for _, b := range padBuckets {
+			if n <= b {
+				return b - n
+			}
+		}
+		// larger frames, up to the negotiated length, are padded to a
+		// multiple of the largest bucket
+		last := padBuckets[len(padBuckets)-1]
+		return (last - n%last) % last
+	case PadRandom:
+		return rand.Intn(maxRandomPadding)
+	}
+	return 0
+}
+
+// StartCover sends cover CmdPing frames while p is idle, at random intervals
+// around interval, until p is closed.
+func (p *Pipe) StartCover(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval/2 + time.Duration(rand.Int63n(int64(interval))))
+			if atomic.LoadInt64(&p.state) == Closed {
+				return
+			}
+			if time.Since(time.Unix(0, atomic.LoadInt64(&p.lastWrite))) < interval {
+				continue
+			}
+			if err := p.writePing(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// writePing writes a CmdPing in the framing p is in, it is not bound to
+// any term or stream.
+func (p *Pipe) writePing() error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if p.mux {
+		return p.writeFrameLocked([]byte{CmdPing, 0, 0, 0, 0, 0, 0, 0}, nil)
+	}
+	return p.writeFrameLocked([]byte{CmdPing, 0, 0, 0}, nil)
+}
+
+func (p *Pipe) setMux() {
+	p.wmu.Lock()
+	p.mux = true
+	p.wmu.Unlock()
+}
@@ -0,0 +1,176 @@
+package pipe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrShortFrame = errors.New("short frame")
+var ErrFrameTooLarge = errors.New("frame too large")
+var ErrFrameTooShort = errors.New("frame payload too short")
+var ErrUnknownCmd = errors.New("unknown cmd")
+
+// maxControlLen bounds the payload of the frames read into the buffer of a
+// pipe rather than streamed.
+const maxControlLen = bufSize - HeaderLen
+
+// FrameError is a malformed frame, Err is one of the errors above.
+type FrameError struct {
+	Cmd    uint8
+	Length int
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%v, cmd: %d, length: %d", e.Err, e.Cmd, e.Length)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// Frame is a decoded frame without its magic. Flags holds FlagCompressed,
+// FlagExtLen and FlagPadded are derived from the length and Pad. Mux selects
+// the multiplexed layout, it must be set before Decode.
+//
+// A frame following the magic is
+// cmd | term | length | [stream id] | [extended length] | [padding length] | payload | padding
+// where the high bits of cmd are flags. The stream id is only present in
+// multiplexed mode, whose second byte is unused. Each command bounds the
+// length of its payload, see payloadBounds.
+type Frame struct {
+	Cmd     uint8
+	Flags   uint8
+	Term    uint8
+	Stream  uint32
+	Mux     bool
+	Pad     int
+	Payload []byte
+}
+
+// frameHeaderLen returns the length of the header starting with b0, the
+// first byte of a frame.
+func frameHeaderLen(b0 uint8, mux bool) int {
+	n := HeaderLen
+	if mux {
+		n += StreamIDLen
+	}
+	if b0&FlagExtLen != 0 {
+		n += ExtLenLen
+	}
+	if b0&FlagPadded != 0 {
+		n += PadLenLen
+	}
+	return n
+}
+
+// payloadBounds returns the bounds of the payload length of cmd.
+func payloadBounds(cmd uint8) (min int, max int, ok bool) {
+	switch cmd {
+	case CmdTrans:
+		return 0, MaxFrameLimit, true
+	case CmdConn, CmdMux, CmdResume:
+		// shorter handshakes are left to verifyHandShake, which checks
+		// their version first
+		return 1, maxControlLen, true
+	case CmdOK, CmdPing, CmdPong:
+		return 0, maxControlLen, true
+	case CmdErr:
+		return 1, 1, true
+	case CmdClose, CmdGoAway:
+		return 0, 0, true
+	case CmdWindow:
+		return 4, 4, true
+	case CmdAck:
+		return SeqLen, SeqLen, true
+	}
+	return 0, 0, false
+}
+
+// decodeHeader decodes the header b, of frameHeaderLen bytes, into f and
+// returns the length of the payload.
+func (f *Frame) decodeHeader(b []byte) (int, error) {
+	if len(b) < HeaderLen || len(b) != frameHeaderLen(b[0], f.Mux) {
+		return 0, &FrameError{Err: ErrShortFrame, Length: len(b)}
+	}
+	f.Flags, f.Cmd, f.Term = b[0]&FlagCompressed, b[0]&CmdMask, b[1]
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	pos := HeaderLen
+	f.Stream = 0
+	if f.Mux {
+		f.Term = 0
+		f.Stream = binary.BigEndian.Uint32(b[pos:])
+		pos += StreamIDLen
+	}
+	if b[0]&FlagExtLen != 0 {
+		length |= int(binary.BigEndian.Uint16(b[pos:])) << 16
+		pos += ExtLenLen
+	}
+	f.Pad = 0
+	if b[0]&FlagPadded != 0 {
+		f.Pad = int(binary.BigEndian.Uint16(b[pos:]))
+	}
+
+	min, max, ok := payloadBounds(f.Cmd)
+	if !ok {
+		return 0, &FrameError{f.Cmd, length, ErrUnknownCmd}
+	}
+	if length > max {
+		return 0, &FrameError{f.Cmd, length, ErrFrameTooLarge}
+	}
+	if length < min {
+		return 0, &FrameError{f.Cmd, length, ErrFrameTooShort}
+	}
+	return length, nil
+}
+
+// Decode decodes the frame at the start of b and returns its length, the
+// payload refers to b.
+func (f *Frame) Decode(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, &FrameError{Err: ErrShortFrame}
+	}
+	hdrLen := frameHeaderLen(b[0], f.Mux)
+	if len(b) < hdrLen {
+		return 0, &FrameError{Cmd: b[0] & CmdMask, Length: len(b), Err: ErrShortFrame}
+	}
+	length, err := f.decodeHeader(b[:hdrLen])
+	if err != nil {
+		return 0, err
+	}
+	n := hdrLen + length + f.Pad
+	if len(b) < n {
+		return 0, &FrameError{f.Cmd, length, ErrShortFrame}
+	}
+	f.Payload = b[hdrLen : hdrLen+length]
+	return n, nil
+}
+
+// Encode appends f to b, padding included, and returns the extended
+// buffer. Pad must fit in 16 bits.
+func (f *Frame) Encode(b []byte) []byte {
+	var hdr [MuxHeaderLen + ExtLenLen + PadLenLen]byte
+	hdr[0] = f.Cmd | f.Flags&FlagCompressed
+	hdrLen := HeaderLen
+	if f.Mux {
+		binary.BigEndian.PutUint32(hdr[HeaderLen:], f.Stream)
+		hdrLen = MuxHeaderLen
+	} else {
+		hdr[1] = f.Term
+	}
+	h := putLength(hdr[:], hdrLen, len(f.Payload))
+	if f.Pad > 0 {
+		h[0] |= FlagPadded
+		h = hdr[:len(h)+PadLenLen]
+		binary.BigEndian.PutUint16(h[len(h)-PadLenLen:], uint16(f.Pad))
+	}
+	b = append(b, h...)
+	b = append(b, f.Payload...)
+	for pad := f.Pad; pad > 0; {
+		n := min(pad, len(zeroPadding))
+		b = append(b, zeroPadding[:n]...)
+		pad -= n
+	}
+	return b
+}
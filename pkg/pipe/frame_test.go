@@ -0,0 +1,81 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+)
+
+// seedFrames are valid frames of both layouts for the fuzz corpus.
+var seedFrames = []Frame{
+	{Cmd: CmdTrans, Term: 1, Payload: []byte("payload")},
+	{Cmd: CmdTrans, Flags: FlagCompressed, Term: 2, Pad: 3, Payload: []byte("compressed")},
+	{Cmd: CmdTrans, Payload: make([]byte, 0x10001)},
+	{Cmd: CmdErr, Term: 1, Payload: []byte{1}},
+	{Cmd: CmdAck, Term: 3, Payload: make([]byte, SeqLen)},
+	{Cmd: CmdGoAway},
+	{Cmd: CmdWindow, Mux: true, Stream: 7, Payload: []byte{0, 1, 0, 0}},
+	{Cmd: CmdTrans, Mux: true, Stream: 1<<32 - 1, Pad: 16, Payload: []byte("stream")},
+}
+
+// equalFrames compares the decoded fields of a and b.
+func equalFrames(a, b *Frame) bool {
+	return a.Cmd == b.Cmd && a.Flags == b.Flags && a.Term == b.Term && a.Stream == b.Stream &&
+		a.Mux == b.Mux && a.Pad == b.Pad && bytes.Equal(a.Payload, b.Payload)
+}
+
+// FuzzFrameDecode decodes arbitrary bytes, frames decoded must encode back
+// to the same frame.
+func FuzzFrameDecode(f *testing.F) {
+	for i := range seedFrames {
+		f.Add(seedFrames[i].Encode(nil), seedFrames[i].Mux)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, mux bool) {
+		fr := Frame{Mux: mux}
+		n, err := fr.Decode(b)
+		if err != nil {
+			return
+		}
+		if n > len(b) {
+			t.Fatalf("decoded %d bytes out of %d", n, len(b))
+		}
+		enc := fr.Encode(nil)
+		got := Frame{Mux: mux}
+		m, err := got.Decode(enc)
+		if err != nil {
+			t.Fatalf("re-encoded frame not decoded, %v", err)
+		}
+		if m != len(enc) || !equalFrames(&fr, &got) {
+			t.Fatalf("frame changed by a round trip, %+v, %+v", fr, got)
+		}
+	})
+}
+
+// FuzzFrameEncode encodes frames within the bounds of their command, they
+// must decode to the same frame.
+func FuzzFrameEncode(f *testing.F) {
+	for _, fr := range seedFrames {
+		f.Add(fr.Cmd, fr.Flags, fr.Term, fr.Stream, fr.Mux, uint16(fr.Pad), fr.Payload)
+	}
+	f.Fuzz(func(t *testing.T, cmd, flags, term uint8, stream uint32, mux bool, pad uint16, payload []byte) {
+		cmd &= CmdMask
+		min, max, ok := payloadBounds(cmd)
+		if !ok || len(payload) < min || len(payload) > max {
+			return
+		}
+		fr := Frame{Cmd: cmd, Flags: flags & FlagCompressed, Term: term, Stream: stream, Mux: mux, Pad: int(pad), Payload: payload}
+		if mux {
+			fr.Term = 0
+		} else {
+			fr.Stream = 0
+		}
+		enc := fr.Encode([]byte("prefix"))
+		got := Frame{Mux: mux}
+		n, err := got.Decode(enc[len("prefix"):])
+		if err != nil {
+			t.Fatalf("encoded frame not decoded, %v", err)
+		}
+		if n != len(enc)-len("prefix") || !equalFrames(&fr, &got) {
+			t.Fatalf("frame changed by a round trip, %+v, %+v", fr, got)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package pipe
+
+import (
+	"sync/atomic"
+
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// A CmdGoAway is sent by a server shutting down on every pipe and session.
+// It belongs to no term or stream and carries no payload. The server stops
+// accepting CmdConn, the client stops reusing the pipe or session once its
+// current connections are done, and opens new ones instead.
+
+// GoAway tells the remote of p to stop reusing it.
+func (p *Pipe) GoAway() error {
+	return p.writeCmd([]byte{CmdGoAway, 0, 0, 0})
+}
+
+// Draining reports whether the remote sent a CmdGoAway on p.
+func (p *Pipe) Draining() bool {
+	return atomic.LoadInt32(&p.goaway) != 0
+}
+
+func (p *Pipe) goAwayReceived() {
+	if atomic.SwapInt32(&p.goaway, 1) == 0 {
+		log.Infof("[%s] remote going away", p)
+	}
+}
+
+// GoAway tells the remote of s to stop opening streams on it.
+func (s *Session) GoAway() error {
+	return s.writeFrame(CmdGoAway, 0, nil)
+}
+
+// Draining reports whether the remote sent a CmdGoAway on s.
+func (s *Session) Draining() bool {
+	return atomic.LoadInt32(&s.goaway) != 0
+}
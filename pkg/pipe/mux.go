@@ -0,0 +1,626 @@
+package pipe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/log"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+// In multiplexed mode every frame header is followed by a 4-byte stream id:
+// magic | cmd | flags | length | stream id | payload
+const StreamIDLen int = 4
+const MuxHeaderLen = HeaderLen + StreamIDLen
+const MuxMaxLen = bufSize - MuxHeaderLen - MagicLen
+
+// DefaultWindow is the initial receive window of a stream when none is
+// configured. Each side announces its own initial window with a CmdWindow
+// frame on stream 0 when the session starts, later CmdWindow frames on a
+// stream grant the sender that many more bytes.
+const DefaultWindow uint32 = 256 * 1024
+
+var ErrSessionClosed = errors.New("session closed")
+var ErrStreamClosed = errors.New("stream closed")
+var ErrFlowControl = errors.New("flow control violated")
+
+// Session multiplexes many logical streams over a single Pipe, so that
+// concurrent CmdConn/CmdTrans/CmdClose exchanges share one connection.
+// Streams are always opened by the client side.
+type Session struct {
+	p          *Pipe
+	mu         sync.Mutex
+	streams    map[uint32]*Stream
+	nextID     uint32
+	window     uint32
+	peerWindow uint32
+	settled    chan struct{}
+	acceptCh   chan *Stream
+	die        chan struct{}
+	dieOnce    sync.Once
+	err        error
+	goaway     int32
+}
+
+// NewClientSession switches p to multiplexed mode by sending CmdMux,
+// authenticated like a CmdConn, and waits for the CmdOK of the remote. window is the initial receive window of each
+// stream, 0 means DefaultWindow.
+func NewClientSession(p *Pipe, user, secret string, window uint32) (*Session, error) {
+	p.setState(InUse)
+	binding, err := p.channelBinding()
+	if err != nil {
+		return nil, err
+	}
+	// frames following CmdMux are multiplexed
+	frame, err := handShakeFrame(CmdMux, p.term, nil, user, secret, p.features.options(), binding)
+	if err != nil {
+		return nil, err
+	}
+	p.setMux()
+	if err := p.writeCmd(frame); err != nil {
+		return nil, err
+	}
+	if err := p.WaitForReply(); err != nil {
+		return nil, err
+	}
+	return newSession(p, window)
+}
+
+// NewServerSession serves p in multiplexed mode, it should be called after
+// WaitForHandShake returns ErrUpgrade and the upgrade is confirmed.
+func NewServerSession(p *Pipe, window uint32) (*Session, error) {
+	return newSession(p, window)
+}
+
+func newSession(p *Pipe, window uint32) (*Session, error) {
+	if window == 0 {
+		window = DefaultWindow
+	}
+	s := &Session{
+		p:        p,
+		streams:  make(map[uint32]*Stream),
+		window:   window,
+		settled:  make(chan struct{}),
+		acceptCh: make(chan *Stream, 64),
+		die:      make(chan struct{}),
+	}
+	p.setMux()
+	// a session lives as long as its streams, idle timeout is not applied
+	p.conn.SetDeadline(time.Time{})
+	if err := s.writeWindow(0, window); err != nil {
+		return nil, err
+	}
+	go s.recvLoop()
+	return s, nil
+}
+
+func (s *Session) String() string {
+	return s.p.String()
+}
+
+// Open opens a new stream and sends an authenticated CmdConn for addr.
+func (s *Session) Open(addr socks.Addr, user, secret string) (*Stream, error) {
+	// the initial window of the remote is required before sending anything
+	select {
+	case <-s.settled:
+	case <-s.die:
+		return nil, s.err
+	}
+
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	s.nextID += 1
+	id := s.nextID
+	s.mu.Unlock()
+	st := newStream(s, id)
+	s.mu.Lock()
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	binding, err := s.p.channelBinding()
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	frame, err := handShakeFrame(CmdConn, 0, addr, user, secret, nil, binding)
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	if err := s.writeFrame(CmdConn, st.id, frame[HeaderLen:]); err != nil {
+		s.closeWithError(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the remote.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.die:
+		return nil, s.err
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.die)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.broadcast()
+		}
+		s.p.Close()
+		log.Debugf("[%s] session closed, %v", s, err)
+	})
+}
+
+func (s *Session) writeFrame(cmd uint8, id uint32, payload []byte) error {
+	var hdr [MuxHeaderLen + ExtLenLen]byte
+	hdr[0] = cmd
+	binary.BigEndian.PutUint32(hdr[HeaderLen:], id)
+	return s.p.writeFrame(putLength(hdr[:], MuxHeaderLen, len(payload)), payload)
+}
+
+func (s *Session) writeWindow(id uint32, n uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return s.writeFrame(CmdWindow, id, b)
+}
+
+// queueWindow is writeWindow for the receive loop, the update is written by
+// the control writer so that the loop does not wait for writers.
+func (s *Session) queueWindow(id uint32, n uint32) {
+	hdr := make([]byte, MuxHeaderLen)
+	hdr[0] = CmdWindow
+	binary.BigEndian.PutUint16(hdr[2:], 4)
+	binary.BigEndian.PutUint32(hdr[HeaderLen:], id)
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	s.p.queueCtl(hdr, b)
+}
+
+func (s *Session) recvLoop() {
+	hdr := make([]byte, MuxHeaderLen+ExtLenLen+PadLenLen)
+	for {
+		if err := s.p.checkMagic(); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if _, err := io.ReadFull(s.p.conn, hdr[:MuxHeaderLen]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		hdrLen := frameHeaderLen(hdr[0], true)
+		if _, err := io.ReadFull(s.p.conn, hdr[MuxHeaderLen:hdrLen]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		f := Frame{Mux: true}
+		length, err := f.decodeHeader(hdr[:hdrLen])
+		if err == nil && length > s.p.frameLen(MuxMaxLen) {
+			err = &FrameError{f.Cmd, length, ErrFrameTooLarge}
+		}
+		if err != nil {
+			s.closeWithError(fmt.Errorf("[%s] %w", s, err))
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.p.conn, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, s.p.conn, int64(f.Pad)); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		// handshakes are authenticated over the header without flags
+		hdr[0] &= CmdMask
+		if err := s.handleFrame(f.Cmd, f.Stream, hdr[:HeaderLen], payload); err != nil {
+			log.Error(err)
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(cmd uint8, id uint32, hdr []byte, payload []byte) error {
+	if cmd == CmdPing {
+		if len(payload) == PingLen {
+			// the receive loop does not wait for writers, as on pipes
+			s.p.queueCtl([]byte{CmdPong, 0, 0, PingLen, 0, 0, 0, 0}, payload)
+		}
+		return nil
+	}
+	if cmd == CmdPong {
+		return nil
+	}
+	if cmd == CmdGoAway {
+		if atomic.SwapInt32(&s.goaway, 1) == 0 {
+			log.Infof("[%s] remote going away", s)
+		}
+		return nil
+	}
+
+	if cmd == CmdWindow {
+		if len(payload) != 4 {
+			return fmt.Errorf("[%s] invalid window update, length: %d", s, len(payload))
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if id == 0 {
+			if n == 0 {
+				return fmt.Errorf("[%s] invalid initial window 0", s)
+			}
+			s.mu.Lock()
+			settled := s.peerWindow != 0
+			s.peerWindow = n
+			s.mu.Unlock()
+			if !settled {
+				close(s.settled)
+			}
+			return nil
+		}
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		if st != nil {
+			st.grant(n)
+		}
+		return nil
+	}
+
+	if cmd == CmdConn {
+		if id == 0 {
+			return fmt.Errorf("[%s] invalid stream id 0", s)
+		}
+		st := newStream(s, id)
+		st.frame = append(append([]byte{}, hdr...), payload...)
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return fmt.Errorf("[%s] duplicated stream %d", s, id)
+		}
+		s.streams[id] = st
+		s.mu.Unlock()
+		select {
+		case s.acceptCh <- st:
+		case <-s.die:
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		log.Warnf("[%s] ignore frame, stream: %d, cmd: %d", s, id, cmd)
+		return nil
+	}
+
+	switch cmd {
+	case CmdTrans:
+		return st.push(payload)
+	case CmdClose:
+		st.remoteClose()
+	case CmdOK:
+		st.reply(nil)
+	case CmdErr:
+		if len(payload) != 1 {
+			return fmt.Errorf("[%s] invalid error reply, length: %d", st, len(payload))
+		}
+		st.finish()
+		st.reply(socks.Error(payload[0]))
+	default:
+		return fmt.Errorf("[%s] unknown cmd: %d", s, cmd)
+	}
+	return nil
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream is a logical connection inside a Session.
+type Stream struct {
+	id         uint32
+	s          *Session
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        []byte
+	frame      []byte
+	replyCh    chan error
+	sendWindow uint32 // bytes the remote is willing to receive
+	recvWindow uint32 // bytes the remote is allowed to send
+	consumed   uint32 // bytes read but not yet granted back to the remote
+	rclosed    bool   // remote sent CmdClose
+	wclosed    bool   // local sent CmdClose
+	closed     bool   // local won't read anymore
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	s.mu.Lock()
+	st := &Stream{
+		id:         id,
+		s:          s,
+		sendWindow: s.peerWindow,
+		recvWindow: s.window,
+		replyCh:    make(chan error, 1),
+	}
+	s.mu.Unlock()
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) String() string {
+	return fmt.Sprintf("pid %04x, S%d", st.s.p.id&0xffff, st.id)
+}
+
+// WaitForHandShake verifies the CmdConn that opened the stream and returns
+// the requested address and the authenticated user.
+func (st *Stream) WaitForHandShake(keys auth.Keys, nonces *NonceCache) (socks.Addr, string, error) {
+	if st.frame == nil {
+		return socks.Addr{}, "", fmt.Errorf("[%s] stream is not opened by remote", st)
+	}
+	binding, err := st.s.p.channelBinding()
+	if err != nil {
+		return socks.Addr{}, "", err
+	}
+	// features are negotiated per session, options of streams are ignored
+	hs, err := verifyHandShake(st.frame, keys, nonces, binding)
+	return hs.addr, hs.user, err
+}
+
+// WaitForReply waits for the remote to confirm the connection requested by
+// Open. If the remote rejects it, the socks.Error sent by the remote is
+// returned and the stream is finished.
+func (st *Stream) WaitForReply() error {
+	select {
+	case err := <-st.replyCh:
+		return err
+	case <-st.s.die:
+		return ErrPipe
+	}
+}
+
+// Confirm tells the remote the requested connection is established.
+func (st *Stream) Confirm() error {
+	return st.s.writeFrame(CmdOK, st.id, nil)
+}
+
+// Reject tells the remote the requested connection failed with code, the
+// stream is finished.
+func (st *Stream) Reject(code socks.Error) error {
+	st.finish()
+	return st.s.writeFrame(CmdErr, st.id, []byte{byte(code)})
+}
+
+func (st *Stream) reply(err error) {
+	select {
+	case st.replyCh <- err:
+	default:
+	}
+}
+
+// finish marks both directions closed without exchanging CmdClose.
+func (st *Stream) finish() {
+	st.mu.Lock()
+	st.rclosed, st.wclosed, st.closed = true, true, true
+	st.buf = nil
+	st.mu.Unlock()
+	st.broadcast()
+	st.s.remove(st.id)
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.rclosed && !st.closed && !st.s.IsClosed() {
+		st.cond.Wait()
+	}
+
+	if len(st.buf) > 0 {
+		n = copy(b, st.buf)
+		st.buf = st.buf[n:]
+		st.consumed += uint32(n)
+		// grant the remote more data once half of the window is consumed
+		var inc uint32
+		if st.consumed >= st.s.window/2 && !st.rclosed {
+			inc = st.consumed
+			st.consumed = 0
+			st.recvWindow += inc
+		}
+		st.mu.Unlock()
+		if inc > 0 {
+			st.s.writeWindow(st.id, inc)
+		}
+		return n, nil
+	}
+	defer st.mu.Unlock()
+
+	if st.rclosed {
+		return 0, io.EOF
+	}
+	if st.closed {
+		return 0, ErrStreamClosed
+	}
+	return 0, ErrPipe
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.wclosed && !st.closed && !st.s.IsClosed() {
+			st.cond.Wait()
+		}
+		if st.wclosed || st.closed {
+			st.mu.Unlock()
+			return n, ErrStreamClosed
+		}
+		if st.s.IsClosed() {
+			st.mu.Unlock()
+			return n, ErrPipe
+		}
+		nBytes := min(len(b)-n, st.s.p.frameLen(MuxMaxLen), int(st.sendWindow))
+		st.sendWindow -= uint32(nBytes)
+		st.mu.Unlock()
+
+		if err = st.s.writeFrame(CmdTrans, st.id, b[n:n+nBytes]); err != nil {
+			st.s.closeWithError(err)
+			return n, ErrPipe
+		}
+		n += nBytes
+	}
+	return n, nil
+}
+
+// CloseWrite tells the remote no more data will be sent.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.wclosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wclosed = true
+	done := st.rclosed && st.closed
+	st.mu.Unlock()
+
+	err := st.s.writeFrame(CmdClose, st.id, nil)
+	if done {
+		st.s.remove(st.id)
+	}
+	return err
+}
+
+// Close closes both directions, pending data is discarded.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.closed = true
+	st.buf = nil
+	st.mu.Unlock()
+	st.broadcast()
+
+	err := st.CloseWrite()
+
+	st.mu.Lock()
+	done := st.rclosed && st.wclosed
+	st.mu.Unlock()
+	if done {
+		st.s.remove(st.id)
+	}
+	return err
+}
+
+func (st *Stream) push(b []byte) error {
+	st.mu.Lock()
+	if uint32(len(b)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("[%s] %v, window: %d, received: %d", st, ErrFlowControl, st.recvWindow, len(b))
+	}
+	st.recvWindow -= uint32(len(b))
+	if st.closed {
+		// nobody is reading, grant the window back right away
+		st.recvWindow += uint32(len(b))
+		st.mu.Unlock()
+		st.s.queueWindow(st.id, uint32(len(b)))
+		return nil
+	}
+	st.buf = append(st.buf, b...)
+	st.mu.Unlock()
+	st.broadcast()
+	return nil
+}
+
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	st.broadcast()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.rclosed = true
+	done := st.closed && st.wclosed
+	st.mu.Unlock()
+	st.broadcast()
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) broadcast() {
+	st.mu.Lock()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// Bind relays data between st and conn until both directions are closed.
+func (st *Stream) Bind(conn net.Conn) error {
+	defer conn.Close()
+	defer st.Close()
+	ch := make(chan error, 1)
+	go func() {
+		// reading from st to conn
+		_, err := io.Copy(conn, st)
+		if err != nil {
+			conn.Close()
+		} else if c, ok := conn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		log.Debugf("[%s] [readLoop] exited, %v", st, err)
+		ch <- err
+	}()
+
+	// reading from conn to st
+	_, err := copyToFrames(st, conn, st.s.p.frameLen(MuxMaxLen))
+	if err == ErrPipe {
+		conn.Close()
+	} else {
+		st.CloseWrite()
+	}
+	log.Debugf("[%s] [writeLoop] exited, %v", st, err)
+	<-ch
+
+	if st.s.IsClosed() {
+		return ErrPipe
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+// sessionPair upgrades both ends of a TCP connection to sessions, as the
+// client and the server do, with the initial window of each side.
+func sessionPair(t *testing.T, clientWindow, serverWindow uint32) (client, server *Session) {
+	t.Helper()
+	c, s := tcpPair(t)
+	type result struct {
+		sess *Session
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		sess, err := NewClientSession(New(c, 0), "alice", "secret", clientWindow)
+		ch <- result{sess, err}
+	}()
+
+	p := New(s, 0)
+	if _, _, err := p.WaitForHandShake(auth.Secret("secret"), NewNonceCache(0)); err != ErrUpgrade {
+		t.Fatalf("expect ErrUpgrade, got %v", err)
+	}
+	if err := p.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerSession(p, serverWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() {
+		r.sess.Close()
+		server.Close()
+	})
+	return r.sess, server
+}
+
+// openStream opens a stream of client and confirms it on server.
+func openStream(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	t.Helper()
+	addr := socks.ParseAddr("example.com:443")
+	st, err := client.Open(addr, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, user, err := remote.WaitForHandShake(auth.Secret("secret"), NewNonceCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" || got.String() != addr.String() {
+		t.Fatalf("got user %q, addr %s", user, got)
+	}
+	if err := remote.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.WaitForReply(); err != nil {
+		t.Fatal(err)
+	}
+	return st, remote
+}
+
+// waitStreams waits for the streams of s to be removed.
+func waitStreams(t *testing.T, s *Session) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("[%s] %d streams left", s, s.NumStreams())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func windows(st *Stream) (send, recv uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sendWindow, st.recvWindow
+}
+
+func TestStreamOpenClose(t *testing.T) {
+	client, server := sessionPair(t, 0, 0)
+	for i := 0; i < 3; i++ {
+		st, remote := openStream(t, client, server)
+
+		data := randomData(100 * 1024)
+		go func() {
+			st.Write(data)
+			st.CloseWrite()
+		}()
+		got, err := io.ReadAll(remote)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes, %v", len(got), err)
+		}
+		go func() {
+			remote.Write(data[:1024])
+			remote.Close()
+		}()
+		if got, err = io.ReadAll(st); err != nil || !bytes.Equal(got, data[:1024]) {
+			t.Fatalf("read %d bytes, %v", len(got), err)
+		}
+		st.Close()
+		waitStreams(t, client)
+		waitStreams(t, server)
+	}
+}
+
+func TestStreamInitialWindow(t *testing.T) {
+	client, server := sessionPair(t, 8*1024, 0)
+	st, remote := openStream(t, client, server)
+	if send, recv := windows(st); send != DefaultWindow || recv != 8*1024 {
+		t.Fatalf("client windows, send: %d, recv: %d", send, recv)
+	}
+	if send, recv := windows(remote); send != 8*1024 || recv != DefaultWindow {
+		t.Fatalf("server windows, send: %d, recv: %d", send, recv)
+	}
+}
+
+func TestStreamWindowRefill(t *testing.T) {
+	const window = 16 * 1024
+	client, server := sessionPair(t, 0, window)
+	st, remote := openStream(t, client, server)
+
+	data := randomData(4 * window)
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		done <- err
+	}()
+
+	// nothing is read, the writer stops once the window is exhausted
+	deadline := time.Now().Add(time.Second)
+	for send, _ := windows(st); send != 0; send, _ = windows(st) {
+		if time.Now().After(deadline) {
+			t.Fatalf("window not exhausted, %d left", send)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("write returned beyond the window, %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(remote, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestStreamDataAfterClose(t *testing.T) {
+	const window = 16 * 1024
+	client, server := sessionPair(t, 0, window)
+	st, remote := openStream(t, client, server)
+	if err := remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(st); err != nil {
+		t.Fatal(err)
+	}
+
+	// the window is returned while a writer of the server is blocked
+	server.p.wmu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(randomData(4 * window))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		server.p.wmu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		server.p.wmu.Unlock()
+		t.Fatal("window of the closed stream not returned")
+	}
+	if _, recv := windows(remote); recv != window {
+		t.Fatalf("receive window %d, expect %d", recv, window)
+	}
+
+	// the session is still usable
+	st.Close()
+	openStream(t, client, server)
+}
@@ -0,0 +1,111 @@
+package pipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A CmdPing carrying PingLen bytes is answered by a CmdPong echoing them,
+// empty pings such as cover traffic are not answered. Neither belongs to a
+// term or a stream.
+const PingLen = 8
+
+// DefaultPingTimeout is how long Ping waits for the pong.
+const DefaultPingTimeout = 3 * time.Second
+
+// RTTStats are the round trip times measured by Ping. Smoothed is an
+// exponentially weighted average as in TCP, Timeouts counts unanswered
+// pings.
+type RTTStats struct {
+	Last     time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Smoothed time.Duration
+	Samples  int
+	Timeouts int
+}
+
+type rttStats struct {
+	mu sync.Mutex
+	RTTStats
+}
+
+// RTT returns the round trip times measured on p.
+func (p *Pipe) RTT() RTTStats {
+	p.rtt.mu.Lock()
+	defer p.rtt.mu.Unlock()
+	return p.rtt.RTTStats
+}
+
+func (s *rttStats) add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Last = d
+	if s.Samples == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	if s.Samples == 0 {
+		s.Smoothed = d
+	} else {
+		s.Smoothed += (d - s.Smoothed) / 8
+	}
+	s.Samples += 1
+}
+
+func (s *rttStats) timeout() {
+	s.mu.Lock()
+	s.Timeouts += 1
+	s.mu.Unlock()
+}
+
+// Ping sends a CmdPing and waits for its CmdPong, returning the round trip
+// time. A pipe that accepts writes but fails to answer within timeout is
+// half dead. p must be idle, nobody else may read from it.
+func (p *Pipe) Ping(timeout time.Duration) (time.Duration, error) {
+	var payload [PingLen]byte
+	sent := time.Now()
+	binary.BigEndian.PutUint64(payload[:], uint64(sent.UnixNano()))
+	if err := p.writeFrame([]byte{CmdPing, 0, 0, PingLen}, payload[:]); err != nil {
+		return 0, err
+	}
+
+	p.pinging = true
+	defer func() {
+		p.pinging = false
+		p.setDeadLine()
+	}()
+	p.conn.SetReadDeadline(sent.Add(timeout))
+	buf := make([]byte, HeaderLen+PingLen)
+	for {
+		n, err := p.readFrame(buf)
+		if IsTimeoutError(err) {
+			p.rtt.timeout()
+			return 0, fmt.Errorf("[%s] no pong in %s", p, timeout)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && buf[0] != CmdPong {
+			return 0, fmt.Errorf("[%s] unexpected cmd while waiting for pong: %d", p, buf[0])
+		}
+		if n == HeaderLen+PingLen && bytes.Equal(buf[HeaderLen:n], payload[:]) {
+			d := time.Since(sent)
+			p.rtt.add(d)
+			return d, nil
+		}
+	}
+}
+
+// handlePing answers a CmdPing read by readFrame, payload is its content.
+// The pong is queued for the control writer, see queueCtl.
+func (p *Pipe) handlePing(payload []byte) {
+	if len(payload) == PingLen {
+		p.queueCtl([]byte{CmdPong, 0, 0, PingLen}, payload)
+	}
+}
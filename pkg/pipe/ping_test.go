@@ -0,0 +1,58 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+)
+
+// serveFrames reads the frames of p until it fails, answering pings.
+func serveFrames(p *Pipe) {
+	buf := make([]byte, bufSize)
+	for {
+		if _, err := p.readFrame(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, s := tcpPair(t)
+	p, remote := New(c, 0), New(s, 0)
+	go serveFrames(remote)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Ping(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := p.RTT(); st.Samples != 3 || st.Timeouts != 0 {
+		t.Fatalf("unexpected rtt stats %+v", st)
+	}
+}
+
+func TestPingWhileWriterBlocked(t *testing.T) {
+	c, s := tcpPair(t)
+	p, remote := New(c, 0), New(s, 0)
+	go serveFrames(remote)
+
+	// a writer of remote blocked on the connection holds wmu
+	remote.wmu.Lock()
+	defer remote.wmu.Unlock()
+	if _, err := p.Ping(time.Second); err != nil {
+		t.Fatalf("pong not sent while wmu is held, %v", err)
+	}
+}
+
+func TestPingPadded(t *testing.T) {
+	c, s := tcpPair(t)
+	p, remote := New(c, 0), New(s, 0)
+	p.grant(PadRandom, CompressNone, 0)
+	remote.grant(PadBucket, CompressNone, 0)
+	go serveFrames(remote)
+
+	for i := 0; i < 10; i++ {
+		if _, err := p.Ping(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
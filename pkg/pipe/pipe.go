@@ -2,17 +2,21 @@ package pipe
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"compress/flate"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/iberryful/sproxy/pkg/auth"
 	"github.com/iberryful/sproxy/pkg/log"
 	"github.com/iberryful/sproxy/pkg/socks"
 )
@@ -25,11 +29,18 @@ const MaxLen = bufSize - HeaderLen - MagicLen
 var Magic = []byte{0xff, 0x86, 0x13, 0x85}
 
 const (
-	CmdClose = iota //0
-	CmdConn         //1
-	CmdTrans        //2
-	CmdPing         //3
-	CmdErr          //4
+	CmdClose  = iota //0
+	CmdConn          //1
+	CmdTrans         //2
+	CmdPing          //3
+	CmdErr           //4
+	CmdMux           //5
+	CmdWindow        //6
+	CmdOK            //7
+	CmdPong          //8
+	CmdAck           //9
+	CmdResume        //10
+	CmdGoAway        //11
 )
 
 const (
@@ -41,31 +52,73 @@ const (
 
 var ErrInterrupted = errors.New("pipe interrupted")
 var ErrPipe = errors.New("pipe closed")
+var ErrUpgrade = errors.New("pipe upgraded to session")
+var ErrMagic = errors.New("invalid magic")
 var scn uint32 = 0
 
 type Pipe struct {
-	conn       net.Conn
-	state      int64
-	readBuf    []byte
-	writeBuf   []byte
-	n          int
-	lastActive time.Time
-	timeout    time.Duration
-	id         uint32
-	term       uint8
+	conn        net.Conn
+	wmu         sync.Mutex
+	ctl         ctlQueue
+	state       int64
+	readBuf     []byte
+	writeBuf    []byte
+	hdrs        []byte
+	frames      []pendingFrame
+	bufs        net.Buffers
+	wbufs       net.Buffers
+	vectored    bool
+	n           int
+	lastActive  time.Time
+	timeout     time.Duration
+	id          uint32
+	term        uint8
+	bindOnce    sync.Once
+	binding     []byte
+	bindErr     error
+	features    Features
+	reply       []byte
+	mux         bool
+	padding     PaddingMode
+	compression Compression
+	maxFrame    int
+	zw          *flate.Writer
+	zbuf        bytes.Buffer
+	zr          io.ReadCloser
+	inflating   bool
+	compressed  bool
+	stats       CompressionStats
+	pad         int
+	pinging     bool
+	rtt         rttStats
+	lastWrite   int64
+	cond        *sync.Cond
+	resume      resumeState
+	resumeReq   resumeRequest
+	redial      func() (net.Conn, error)
+	user        string
+	secret      string
+	goaway      int32
+
+	resumeTimeout time.Duration
 }
 
 func New(conn net.Conn, timeout time.Duration) *Pipe {
 	p := &Pipe{
-		conn:       conn,
-		state:      Idle,
-		readBuf:    make([]byte, bufSize),
-		writeBuf:   make([]byte, bufSize),
-		timeout:    timeout,
-		lastActive: time.Now(),
-		id:         atomic.AddUint32(&scn, 1),
-	}
-	copy(p.writeBuf, Magic)
+		conn:          conn,
+		state:         Idle,
+		readBuf:       make([]byte, bufSize),
+		writeBuf:      make([]byte, 0, 2*(bufSize+PadLenLen)),
+		hdrs:          make([]byte, 0, 4*(MagicLen+MuxHeaderLen+PadLenLen)+copyThreshold),
+		vectored:      vectored(conn),
+		timeout:       timeout,
+		lastActive:    time.Now(),
+		id:            atomic.AddUint32(&scn, 1),
+		resumeTimeout: DefaultResumeTimeout,
+	}
+	p.cond = sync.NewCond(&p.wmu)
+	p.ctl.conn = conn
+	p.resume.space = sync.NewCond(&p.resume.amu)
 	return p
 }
 
@@ -75,7 +128,7 @@ func (p *Pipe) checkMagic() error {
 		return err
 	}
 	if !bytes.Equal(Magic, p.readBuf[:len(Magic)]) {
-		return fmt.Errorf("invalid magic, %x", p.readBuf[:len(Magic)])
+		return fmt.Errorf("%w, %x", ErrMagic, p.readBuf[:len(Magic)])
 	}
 
 	return nil
@@ -94,6 +147,15 @@ func (p *Pipe) setDeadLine() {
 	p.conn.SetDeadline(t)
 }
 
+// channelBinding returns the channel binding of the underlying connection,
+// it must be called after the TLS handshake.
+func (p *Pipe) channelBinding() ([]byte, error) {
+	p.bindOnce.Do(func() {
+		p.binding, p.bindErr = channelBinding(p.conn)
+	})
+	return p.binding, p.bindErr
+}
+
 func (p *Pipe) String() string {
 	return fmt.Sprintf("pid %04x, T%d", p.id&0xffff, p.term)
 }
@@ -103,15 +165,24 @@ func (p *Pipe) Close() error {
 		return nil
 	}
 	p.setState(Closed)
+	// writers waiting for acks or a new connection give up
+	p.cond.Broadcast()
+	p.wakeWriters()
 	return p.conn.Close()
 }
 
+func (p *Pipe) IsClosed() bool {
+	return atomic.LoadInt64(&p.state) == Closed
+}
+
 func (p *Pipe) setState(state int64) {
 	atomic.StoreInt64(&p.state, state)
 }
 
 func (p *Pipe) reset() error {
 	p.setDeadLine()
+	p.resetCompression()
+	p.resetResume()
 	p.term += 1
 	p.setState(Idle)
 	return nil
@@ -120,24 +191,73 @@ func (p *Pipe) reset() error {
 func (p *Pipe) Read(b []byte) (n int, err error) {
 	// not in progress
 	p.setDeadLine()
+	if p.inflating {
+		return p.inflate(b)
+	}
+	for {
+		if p.n == 0 {
+			if n, err = p.readFrame(b); n > 0 || err != nil {
+				return n, err
+			}
+			if p.compressed {
+				return p.inflate(b)
+			}
+		}
+
+		nBytes := min(len(b), p.n)
+
+		n, err = p.conn.Read(b[:nBytes])
+		p.n -= n
+		p.received(n)
+		if err == nil || !p.recoverRead(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// readFrame reads frames until a CmdTrans with payload, which is left for
+// the caller to read, or a control frame, which is copied to b. In a
+// resumable term it recovers from the loss of the connection.
+func (p *Pipe) readFrame(b []byte) (n int, err error) {
+	for {
+		n, err = p.readFrameOnce(b)
+		if err == nil || !p.recoverRead(err) {
+			return n, err
+		}
+	}
+}
+
+func (p *Pipe) readFrameOnce(b []byte) (n int, err error) {
 	for p.n == 0 {
+		if err := p.discardPadding(); err != nil {
+			return 0, err
+		}
+
 		err := p.checkMagic()
 		if err != nil {
 			return 0, err
 		}
 
-		_, err = io.ReadFull(p.conn, p.readBuf[:4])
+		if _, err = io.ReadFull(p.conn, p.readBuf[:HeaderLen]); err != nil {
+			return 0, err
+		}
+		hdrLen := frameHeaderLen(p.readBuf[0], false)
+		if _, err = io.ReadFull(p.conn, p.readBuf[HeaderLen:hdrLen]); err != nil {
+			return 0, err
+		}
+		var f Frame
+		length, err := f.decodeHeader(p.readBuf[:hdrLen])
 		if err != nil {
 			return 0, err
 		}
-
-		cmd, term, length := p.readBuf[0], p.readBuf[1], int(p.readBuf[2])*256+int(p.readBuf[3])
-		if cmd < CmdErr && term != p.term {
-			if length > 0 {
-				_, err = io.ReadFull(p.conn, p.readBuf[4:])
-				if err != nil {
-					return 0, err
-				}
+		cmd, term := f.Cmd, f.Term
+		p.pad = f.Pad
+		if isTermCmd(cmd) && term != p.term {
+			if _, err = io.CopyN(ioutil.Discard, p.conn, int64(length)); err != nil {
+				return 0, err
 			}
 			log.Warnf("[%s] ignore frame, term: %d, cmd: %d", p, term, cmd)
 			continue
@@ -145,57 +265,101 @@ func (p *Pipe) Read(b []byte) (n int, err error) {
 		switch cmd {
 		case CmdClose:
 			return 0, ErrInterrupted
-		case CmdConn:
+		case CmdConn, CmdMux, CmdResume, CmdOK, CmdErr:
+			if HeaderLen+length > len(b) {
+				return 0, &FrameError{cmd, length, ErrFrameTooLarge}
+			}
 			_, err = io.ReadFull(p.conn, p.readBuf[4:4+length])
 			if err != nil {
 				return 0, err
 			}
+			// the next frame may be read by a Session, not by p
+			if err = p.discardPadding(); err != nil {
+				return 0, err
+			}
 
+			// the frame is returned as it was sent, before padding
+			p.readBuf[0] = cmd
 			copy(b, p.readBuf[:4+length])
 			return 4 + length, nil
 		case CmdTrans:
+			if length > p.frameLen(MaxLen) {
+				return 0, &FrameError{cmd, length, ErrFrameTooLarge}
+			}
+			p.compressed = f.Flags&FlagCompressed != 0
+			if p.resume.active {
+				skip, err := p.trans(length)
+				if err != nil {
+					return 0, err
+				}
+				// data replayed after a resumption may have been received
+				if _, err = io.CopyN(ioutil.Discard, p.conn, int64(skip)); err != nil {
+					return 0, err
+				}
+				length -= SeqLen + skip
+			}
 			p.n = length
-		case CmdPing:
-			continue
+		case CmdAck:
+			if _, err = io.ReadFull(p.conn, p.readBuf[4:4+SeqLen]); err != nil {
+				return 0, err
+			}
+			p.ack(binary.BigEndian.Uint64(p.readBuf[4:]))
+		case CmdGoAway:
+			p.goAwayReceived()
+		case CmdPing, CmdPong:
+			if _, err = io.ReadFull(p.conn, p.readBuf[4:4+length]); err != nil {
+				return 0, err
+			}
+			if cmd == CmdPing {
+				p.handlePing(p.readBuf[4 : 4+length])
+				continue
+			}
+			// late pongs are dropped
+			if !p.pinging {
+				continue
+			}
+			if HeaderLen+length > len(b) {
+				return 0, &FrameError{cmd, length, ErrFrameTooLarge}
+			}
+			p.readBuf[0] = cmd
+			copy(b, p.readBuf[:4+length])
+			return 4 + length, nil
 		default:
 			err := fmt.Errorf("[%s] unknown cmd: %d", p, cmd)
 			log.Error(err)
 			return 0, err
 		}
 	}
+	return 0, nil
+}
 
-	nBytes := min(len(b), p.n)
-
-	n, err = p.conn.Read(b[:nBytes])
-	p.n -= n
-
-	return n, err
+func (p *Pipe) discardPadding() error {
+	if p.pad == 0 {
+		return nil
+	}
+	_, err := io.CopyN(ioutil.Discard, p.conn, int64(p.pad))
+	p.pad = 0
+	return err
 }
 
 func (p *Pipe) Write(b []byte) (n int, err error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
 	p.setDeadLine()
-	n = len(b)
-	m := len(Magic)
-	pos := 0
-	for n > 0 {
-		nBytes := min(n, MaxLen)
-		copy(p.writeBuf[m:], []byte{CmdTrans, p.term, byte(nBytes >> 8), byte(nBytes % 256)})
-		copy(p.writeBuf[m+4:], b[pos:pos+nBytes])
-
-		if _, err = p.conn.Write(p.writeBuf[:m+4+nBytes]); err != nil {
-			return 0, err
-		}
-
-		pos += nBytes
-		n -= nBytes
+	if p.compression != CompressNone {
+		return p.writeCompressedLocked(b)
 	}
-
-	return len(b), nil
+	return p.sendLocked(0, b)
 }
 
 // reading from p to conn
 func (p *Pipe) readLoop(conn net.Conn) error {
-	_, err := io.Copy(conn, p)
+	var err error
+	if p.resume.active {
+		err = p.copyResumable(conn)
+	} else {
+		_, err = io.Copy(conn, p)
+	}
 
 	// p read closed, should close p
 	if !IsInterrupted(err) {
@@ -214,7 +378,7 @@ func (p *Pipe) readLoop(conn net.Conn) error {
 
 // reading from conn to pipe
 func (p *Pipe) writeLoop(conn net.Conn) error {
-	_, err := io.Copy(p, conn)
+	_, err := copyToFrames(p, conn, p.frameLen(MaxLen))
 
 	if p.IsPipeErr(err) {
 		conn.Close()
@@ -231,7 +395,9 @@ func (p *Pipe) writeLoop(conn net.Conn) error {
 	if err == nil || IsReadError(err) {
 		log.Debugf("[%s] [writeLoop] interrupted by local", p)
 		// Normally, remote should send FIN signal, setting deadline here is just to make sure the read loop can exit.
+		p.wmu.Lock()
 		p.conn.SetDeadline(time.Now().Add(1 * time.Second))
+		p.wmu.Unlock()
 		conn.(*net.TCPConn).CloseRead()
 		return nil
 	}
@@ -253,60 +419,120 @@ func (p *Pipe) Bind(conn net.Conn) error {
 	log.Debugf("[%s] [writeLoop] exited, %v", p, writeLoopErr)
 	readLoopErr = <-ch
 
+	if p.compression != CompressNone {
+		st := p.CompressionStats()
+		log.Debugf("[%s] compressed, out: %d -> %d bytes, in: %d -> %d bytes", p, st.RawOut, st.CompressedOut, st.CompressedIn, st.RawIn)
+	}
+
 	if p.IsPipeErr(readLoopErr) || p.IsPipeErr(writeLoopErr) {
 		return ErrPipe
 	}
 	return p.reset()
 }
 
-func (p *Pipe) HandShake(addr socks.Addr, secret string) error {
+func (p *Pipe) HandShake(addr socks.Addr, user, secret string) error {
 	p.setState(InUse)
-	buf := make([]byte, 1024)
-	addrLen := len(addr)
-	headerLen := addrLen + 32
-	n := 4 + addrLen
-	buf[0] = CmdConn
-	buf[1] = p.term
-	buf[2] = uint8(headerLen >> 8)
-	buf[3] = uint8(headerLen % 256)
-	copy(buf[4:], addr)
-
-	hmac := sha256.Sum256(append(buf[:n], []byte(secret)...))
-	copy(buf[n:], hmac[:])
-	return p.writeCmd(buf[:n+32])
+	binding, err := p.channelBinding()
+	if err != nil {
+		return err
+	}
+	// kept to resume the term
+	frame, err := handShakeFrame(CmdConn, p.term, addr, user, secret, p.features.options(), binding)
+	if err != nil {
+		return err
+	}
+	p.user, p.secret = user, secret
+	return p.writeCmd(frame)
 }
 
-func (p *Pipe) WaitForHandShake(secret string) (socks.Addr, error) {
+// WaitForHandShake waits for a CmdConn and returns the requested address and
+// the authenticated user. ErrUpgrade is returned with the user if the remote
+// switches the pipe to multiplexed mode instead, ErrResume if it resumes
+// another pipe, see ResumeTable. Nil keys skip the secret check, for
+// clients authenticated by their TLS certificate.
+func (p *Pipe) WaitForHandShake(keys auth.Keys, nonces *NonceCache) (socks.Addr, string, error) {
 	p.setState(InUse)
 	buf := make([]byte, 1024)
 	var err error
 	n, err := p.Read(buf)
 	if err != nil || n < 4 {
-		return socks.Addr{}, err
+		return socks.Addr{}, "", err
 	}
 
-	if buf[0] != CmdConn {
-		return socks.Addr{}, fmt.Errorf("invalid handshake cmd: %d", buf[0])
+	if buf[0] != CmdConn && buf[0] != CmdMux && buf[0] != CmdResume {
+		return socks.Addr{}, "", fmt.Errorf("%w, cmd: %d", ErrHandShake, buf[0])
 	}
 
-	length := 256*int(buf[2]) + int(buf[3])
-	// n is the frame header without hmac
-	n = 4 + length - 32
-
-	msg := make([]byte, n+len(secret))
-	copy(msg[:n], buf[:n])
-	copy(msg[n:n+len(secret)], secret)
+	binding, err := p.channelBinding()
+	if err != nil {
+		return socks.Addr{}, "", err
+	}
+	hs, err := verifyHandShake(buf[:n], keys, nonces, binding)
+	if err != nil {
+		return hs.addr, hs.user, err
+	}
+	p.user = hs.user
+	if buf[0] == CmdResume {
+		// replies belong to the term resumed
+		p.term = buf[1]
+		if p.resumeReq, err = parseResumeRequest(hs.options); err != nil {
+			return socks.Addr{}, hs.user, err
+		}
+		return socks.Addr{}, hs.user, ErrResume
+	}
+	if p.reply, err = p.acceptOptions(buf[0], hs.options); err != nil {
+		return hs.addr, hs.user, err
+	}
+	if buf[0] == CmdMux {
+		return socks.Addr{}, hs.user, ErrUpgrade
+	}
+	return hs.addr, hs.user, nil
+}
 
-	hmac := sha256.Sum256(msg)
+// WaitForReply waits for the remote to confirm the connection requested by
+// HandShake. If the remote rejects it, the socks.Error sent by the remote is
+// returned and the pipe is ready for the next term.
+func (p *Pipe) WaitForReply() error {
+	buf := make([]byte, 512)
+	n, err := p.Read(buf)
+	if err != nil {
+		return err
+	}
 
-	if !bytes.Equal(hmac[:], buf[n:n+32]) {
-		return socks.Addr{}, fmt.Errorf("invalid handshake hmac, expect %x, got %x", hmac, buf[n:n+32])
+	switch buf[0] {
+	case CmdOK:
+		return p.applyOptions(buf[HeaderLen:n])
+	case CmdErr:
+		if n < 5 {
+			return fmt.Errorf("[%s] invalid error reply, length: %d", p, n)
+		}
+		p.reset()
+		return socks.Error(buf[4])
 	}
+	return fmt.Errorf("[%s] invalid reply cmd: %d", p, buf[0])
+}
 
-	return buf[4:n], nil
+// Confirm tells the remote the requested connection is established, along
+// with the features granted at handshake.
+func (p *Pipe) Confirm() error {
+	return p.writeFrame([]byte{CmdOK, p.term, byte(len(p.reply) >> 8), byte(len(p.reply))}, p.reply)
+}
+
+// Reject tells the remote the requested connection failed with code, the pipe
+// is ready for the next term.
+func (p *Pipe) Reject(code socks.Error) error {
+	err := p.writeCmd([]byte{CmdErr, p.term, 0, 1, byte(code)})
+	if err != nil {
+		return err
+	}
+	return p.reset()
 }
 
 func (p *Pipe) TryInterruptRemote() error {
+	p.wmu.Lock()
+	// replayed if the connection is lost before the remote reads it
+	p.resume.closeSent = p.resume.active
+	p.wmu.Unlock()
 	err := p.writeCmd([]byte{CmdClose, p.term, 0, 0})
 	if err != nil {
 		return err
@@ -320,13 +546,13 @@ func (p *Pipe) TryPing() error {
 	return p.writeCmd([]byte{CmdPing, p.term, 0, 0})
 }
 
-func (p *Pipe) writeCmd(b []byte) error {
-	m := len(Magic)
-	buf := make([]byte, m+len(b))
-	copy(buf[:m], Magic)
-	copy(buf[m:], b)
-	_, err := p.conn.Write(buf)
-	return err
+// isTermCmd reports whether frames of cmd belong to a single term.
+func isTermCmd(cmd uint8) bool {
+	switch cmd {
+	case CmdClose, CmdConn, CmdTrans, CmdOK, CmdErr, CmdAck:
+		return true
+	}
+	return false
 }
 
 func min(nums ...int) int {
@@ -354,7 +580,9 @@ func (p *Pipe) IsPipeErr(err error) bool {
 		return false
 	}
 	if e, ok := err.(*net.OpError); ok {
+		p.wmu.Lock()
 		addr := p.conn.LocalAddr().String()
+		p.wmu.Unlock()
 		return e != nil && (addr == e.Source.String() || addr == e.Addr.String())
 	}
 	return strings.ContainsAny(err.Error(), ErrPipe.Error())
@@ -2,102 +2,371 @@ package pipe
 
 import (
 	"container/list"
-	"github.com/iberryful/sproxy/pkg/log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
+
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// PoolState is the state of a pipe in a pool.
+type PoolState uint8
+
+const (
+	PoolNone  PoolState = iota // 0, not in the pool, or evicted or discarded
+	PoolIdle                   // 1, waiting in the pool
+	PoolInUse                  // 2, checked out by Get
 )
 
+func (s PoolState) String() string {
+	switch s {
+	case PoolIdle:
+		return "idle"
+	case PoolInUse:
+		return "in use"
+	}
+	return "none"
+}
+
+// PoolStats are the pipes of a pool. InUse counts the pipes checked out by
+// Get and not yet returned nor discarded, those still being dialed
+// included. Evicted pipes were closed by the pool, because they aged, failed
+// a ping, overflowed the pool or were refused by a server going away.
+// Discarded pipes were closed by the caller of Get.
+type PoolStats struct {
+	Idle         int
+	InUse        int
+	Created      int64
+	Evicted      int64
+	Discarded    int64
+	DialFailures int64
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("idle: %d, in use: %d, created: %d, evicted: %d, discarded: %d, dial failures: %d",
+		s.Idle, s.InUse, s.Created, s.Evicted, s.Discarded, s.DialFailures)
+}
+
+// Pool keeps idle pipes for reuse. A pipe is checked out by Get, then
+// either returned by Put or closed by Discard. Idle pipes are handed out
+// most recently returned first, and evicted once idle for maxAge.
 type Pool struct {
-	mu            sync.Mutex
-	l             list.List
-	maxAge        time.Duration
-	maxSize       int
-	lowWarterMark int
-	gcInerval     time.Duration
-	New           func() (*Pipe, error)
+	mu           sync.Mutex
+	cond         *sync.Cond
+	idle         list.List
+	states       map[*Pipe]PoolState
+	inFlight     int
+	stats        PoolStats
+	maxAge       time.Duration
+	maxSize      int
+	lowWaterMark int
+	gcInterval   time.Duration
+	New          func() (*Pipe, error)
+	// PingTimeout is how long a pipe idle for verifyIdle has to answer a
+	// ping before it is handed out, pipes failing to are evicted.
+	PingTimeout time.Duration
+	// MaxInFlight bounds the pipes checked out at once, Get waits for one
+	// to be returned beyond it. 0 means no bound.
+	MaxInFlight int
+	// WaitTimeout is how long Get waits beyond MaxInFlight before failing
+	// with ErrPoolExhausted, 0 means DefaultWaitTimeout.
+	WaitTimeout time.Duration
 }
 
+// errGoAway evicts the pipes whose remote is going away.
+var errGoAway = errors.New("remote going away")
+
+var ErrPoolExhausted = errors.New("too many pipes in use")
+
+// DefaultWaitTimeout is how long Get waits for a pipe beyond MaxInFlight
+// when Pool.WaitTimeout is not set.
+const DefaultWaitTimeout = 30 * time.Second
+
+// verifyIdle is the idle time after which a pipe is pinged by Get.
+const verifyIdle = 5 * time.Second
+
 func NewPool(maxSize int, maxAge time.Duration, newFunc func() (*Pipe, error)) *Pool {
+	p := newPool(maxSize, maxAge, newFunc)
+	go p.gcLoop()
+	return p
+}
+
+// newPool creates a pool not filled nor cleaned up by gcLoop.
+func newPool(maxSize int, maxAge time.Duration, newFunc func() (*Pipe, error)) *Pool {
 	p := &Pool{
-		mu:            sync.Mutex{},
-		l:             list.List{},
-		maxAge:        maxAge,
-		maxSize:       maxSize,
-		lowWarterMark: max(8, maxSize>>1),
-		gcInerval:     maxAge >> 2,
-		New:           newFunc,
+		states:       make(map[*Pipe]PoolState),
+		maxAge:       maxAge,
+		maxSize:      maxSize,
+		lowWaterMark: max(8, maxSize>>1),
+		gcInterval:   maxAge >> 2,
+		New:          newFunc,
+		PingTimeout:  DefaultPingTimeout,
 	}
-	go p.gcLoop()
+	p.cond = sync.NewCond(&p.mu)
 	return p
 }
 
+// Len returns the number of idle pipes.
 func (pool *Pool) Len() int {
-	return pool.l.Len()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.idle.Len()
 }
 
+// State returns the state of p in the pool.
+func (pool *Pool) State(p *Pipe) PoolState {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.states[p]
+}
+
+// Stats returns the pipes of the pool.
+func (pool *Pool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	s := pool.stats
+	s.Idle = pool.idle.Len()
+	s.InUse = pool.inFlight
+	return s
+}
+
+// Get checks out an idle pipe, or a new one if there is none. Pipes idle
+// for verifyIdle are pinged first, those failing to answer or whose remote
+// is going away are evicted.
 func (pool *Pool) Get() (*Pipe, error) {
 	pool.mu.Lock()
-	pool.cleanup()
-	if pool.l.Len() > 0 {
-		elem := pool.l.Front()
-		p := elem.Value.(*Pipe)
+	if err := pool.waitLocked(); err != nil {
 		pool.mu.Unlock()
-		return p, nil
+		return nil, err
+	}
+	pool.inFlight += 1
+	for {
+		expired := pool.cleanup()
+		elem := pool.idle.Back()
+		var p *Pipe
+		if elem != nil {
+			p = pool.idle.Remove(elem).(*Pipe)
+			pool.states[p] = PoolInUse
+		}
+		pool.mu.Unlock()
+		pool.closeAll(expired)
+		if p == nil {
+			return pool.dial()
+		}
+
+		var err error
+		switch {
+		case p.Draining():
+			err = errGoAway
+		case time.Since(p.lastActive) < verifyIdle:
+			return p, nil
+		default:
+			var rtt time.Duration
+			rtt, err = p.Ping(pool.PingTimeout)
+			// a CmdGoAway may arrive before the pong
+			if err == nil && p.Draining() {
+				err = errGoAway
+			}
+			if err == nil {
+				log.Debugf("[%s] pong in %s, smoothed rtt: %s", p, rtt, p.RTT().Smoothed)
+				return p, nil
+			}
+		}
+		log.Warnf("[%s] evicted, %v", p, err)
+		p.Close()
+		pool.mu.Lock()
+		pool.evict(p)
 	}
-	pool.mu.Unlock()
-	return pool.New()
 }
 
-func (pool *Pool) Put(p *Pipe) {
+// waitLocked waits up to WaitTimeout for a pipe to be returned while
+// MaxInFlight are checked out, lock required.
+func (pool *Pool) waitLocked() error {
+	if pool.MaxInFlight <= 0 || pool.inFlight < pool.MaxInFlight {
+		return nil
+	}
+	timeout := pool.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		pool.mu.Lock()
+		pool.cond.Broadcast()
+		pool.mu.Unlock()
+	})
+	defer timer.Stop()
+	for pool.inFlight >= pool.MaxInFlight {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w, waited %s for one of %d", ErrPoolExhausted, timeout, pool.MaxInFlight)
+		}
+		pool.cond.Wait()
+	}
+	return nil
+}
+
+// dial creates a pipe checked out by Get.
+func (pool *Pool) dial() (*Pipe, error) {
+	p, err := pool.create()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	pool.states[p] = PoolInUse
+	return p, nil
+}
+
+// create dials a pipe, not in the pool yet.
+func (pool *Pool) create() (*Pipe, error) {
+	p, err := pool.New()
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
-	for pool.l.Len() >= pool.maxSize {
-		elem := pool.l.Front()
-		p := elem.Value.(*Pipe)
+	if err != nil {
+		pool.stats.DialFailures += 1
+		return nil, err
+	}
+	pool.stats.Created += 1
+	return p, nil
+}
+
+// Put returns p, checked out by Get, to the pool. Pipes the remote is
+// going away from are evicted instead.
+func (pool *Pool) Put(p *Pipe) {
+	pool.mu.Lock()
+	if state := pool.states[p]; state != PoolInUse {
+		pool.mu.Unlock()
+		log.Warnf("[%s] returned to the pool while %s", p, state)
+		return
+	}
+	pool.release()
+	if p.Draining() || p.IsClosed() {
+		pool.evict(p)
+		pool.mu.Unlock()
 		p.Close()
-		pool.l.Remove(elem)
+		return
+	}
+	overflow := pool.addIdle(p)
+	pool.mu.Unlock()
+	pool.closeAll(overflow)
+}
+
+// Discard closes p, checked out by Get, instead of returning it.
+func (pool *Pool) Discard(p *Pipe) {
+	pool.mu.Lock()
+	if pool.states[p] == PoolInUse {
+		pool.release()
+		delete(pool.states, p)
+		pool.stats.Discarded += 1
 	}
+	pool.mu.Unlock()
+	p.Close()
+}
 
+// release ends a checkout, lock required.
+func (pool *Pool) release() {
+	pool.inFlight -= 1
+	pool.cond.Signal()
+}
+
+// evict removes p, which must not be idle, to be closed without the lock.
+// Lock required.
+func (pool *Pool) evict(p *Pipe) {
+	delete(pool.states, p)
+	pool.stats.Evicted += 1
+}
+
+// addIdle adds p to the idle pipes and returns the oldest ones it
+// overflows, to be closed without the lock. Lock required.
+func (pool *Pool) addIdle(p *Pipe) []*Pipe {
+	var overflow []*Pipe
+	for pool.idle.Len() > 0 && pool.idle.Len() >= pool.maxSize {
+		overflow = append(overflow, pool.removeIdle(pool.idle.Front()))
+	}
 	p.lastActive = time.Now()
-	pool.l.PushBack(p)
-}
-
-// Lock required
-func (pool *Pool) cleanup() int {
-	r := 0
-	for pool.l.Len() > 0 {
-		elem := pool.l.Front()
-		p := elem.Value.(*Pipe)
-		pool.l.Remove(elem)
-		if time.Now().Sub(p.lastActive) < pool.maxAge {
-			return r
+	pool.states[p] = PoolIdle
+	pool.idle.PushBack(p)
+	return overflow
+}
+
+// removeIdle evicts the idle pipe of elem and returns it, lock required.
+func (pool *Pool) removeIdle(elem *list.Element) *Pipe {
+	p := pool.idle.Remove(elem).(*Pipe)
+	delete(pool.states, p)
+	pool.stats.Evicted += 1
+	return p
+}
+
+// cleanup evicts the pipes idle for maxAge and returns them, to be closed
+// without the lock. Lock required.
+func (pool *Pool) cleanup() []*Pipe {
+	var expired []*Pipe
+	for pool.idle.Len() > 0 {
+		elem := pool.idle.Front()
+		if time.Since(elem.Value.(*Pipe).lastActive) < pool.maxAge {
+			break
 		}
-		r += 1
+		expired = append(expired, pool.removeIdle(elem))
+	}
+	return expired
+}
+
+func (pool *Pool) closeAll(pipes []*Pipe) {
+	for _, p := range pipes {
 		p.Close()
 	}
-	return r
+}
+
+// add adds p, not in the pool yet, to the idle pipes.
+func (pool *Pool) add(p *Pipe) {
+	pool.mu.Lock()
+	overflow := pool.addIdle(p)
+	pool.mu.Unlock()
+	pool.closeAll(overflow)
 }
 
 func (pool *Pool) gc() {
 	pool.mu.Lock()
-	r := pool.cleanup()
-	n := max(0, pool.lowWarterMark-pool.l.Len())
+	expired := pool.cleanup()
+	n := max(0, pool.lowWaterMark-pool.idle.Len())
 	pool.mu.Unlock()
+	pool.closeAll(expired)
+
 	for i := 0; i < n; i++ {
-		go func() {
-			p, err := pool.New()
-			if err == nil {
-				pool.Put(p)
-			}
-		}()
+		if i > 0 {
+			go func() {
+				if p, err := pool.create(); err == nil {
+					pool.add(p)
+				}
+			}()
+			continue
+		}
+		// the first pipe is dialed alone and pinged, reading the TLS 1.3
+		// session tickets, so that the others can resume its session
+		p, err := pool.create()
+		if err != nil {
+			log.Warnf("error creating pipe, %s", err)
+			continue
+		}
+		if _, err := p.Ping(pool.PingTimeout); err != nil {
+			log.Warnf("[%s] evicted, %v", p, err)
+			pool.mu.Lock()
+			pool.stats.Evicted += 1
+			pool.mu.Unlock()
+			p.Close()
+			continue
+		}
+		pool.add(p)
 	}
-	log.Infof("[GC loop]removed %d pipes, added %d pipes", r, n)
+	log.Infof("[GC loop]removed %d pipes, added %d pipes, %s", len(expired), n, pool.Stats())
 }
 
 func (pool *Pool) gcLoop() {
 	log.Info("start gc loop")
 	pool.gc()
-	for range time.Tick(pool.gcInerval) {
+	for range time.Tick(pool.gcInterval) {
 		pool.gc()
 	}
 }
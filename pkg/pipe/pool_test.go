@@ -0,0 +1,143 @@
+package pipe
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPool returns a pool of up to maxSize pipes over TCP, whose remotes
+// answer pings.
+func testPool(t *testing.T, maxSize int) *Pool {
+	return newPool(maxSize, time.Minute, func() (*Pipe, error) {
+		c, s := tcpPair(t)
+		go serveFrames(New(s, 0))
+		return New(c, 0), nil
+	})
+}
+
+// checkStats checks that every pipe created is accounted for once none is
+// checked out.
+func checkStats(t *testing.T, pool *Pool) PoolStats {
+	t.Helper()
+	st := pool.Stats()
+	if st.InUse != 0 || st.Created != int64(st.Idle)+st.Evicted+st.Discarded {
+		t.Fatalf("pipes not accounted for, %s", st)
+	}
+	return st
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	pool := testPool(t, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 100; j++ {
+				p, err := pool.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if pool.State(p) != PoolInUse {
+					t.Errorf("[%s] checked out while %s", p, pool.State(p))
+				}
+				if rnd.Intn(4) == 0 {
+					pool.Discard(p)
+				} else {
+					pool.Put(p)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	st := checkStats(t, pool)
+	if st.Idle > 4 || st.Discarded == 0 || st.DialFailures != 0 {
+		t.Fatalf("unexpected stats, %s", st)
+	}
+}
+
+func TestPoolDialFailure(t *testing.T) {
+	errDial := errors.New("dial failed")
+	pool := newPool(4, time.Minute, func() (*Pipe, error) {
+		return nil, errDial
+	})
+	pool.MaxInFlight = 1
+	for i := 0; i < 2; i++ {
+		if _, err := pool.Get(); err != errDial {
+			t.Fatalf("got %v, want %v", err, errDial)
+		}
+	}
+	if st := checkStats(t, pool); st.DialFailures != 2 {
+		t.Fatalf("unexpected stats, %s", st)
+	}
+}
+
+func TestPoolMaxInFlight(t *testing.T) {
+	pool := testPool(t, 4)
+	pool.MaxInFlight = 2
+	a, _ := pool.Get()
+	pool.Get()
+
+	got := make(chan *Pipe, 1)
+	go func() {
+		p, err := pool.Get()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- p
+	}()
+	select {
+	case <-got:
+		t.Fatal("more than MaxInFlight pipes checked out")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.Put(a)
+	select {
+	case p := <-got:
+		if p != a {
+			t.Fatal("the returned pipe not handed out")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get still waiting after a Put")
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	pool := testPool(t, 4)
+	pool.MaxInFlight = 1
+	pool.WaitTimeout = 50 * time.Millisecond
+	p, _ := pool.Get()
+	if _, err := pool.Get(); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("got %v, want %v", err, ErrPoolExhausted)
+	}
+	pool.Discard(p)
+	if _, err := pool.Get(); err != nil {
+		t.Fatalf("no pipe after a Discard, %v", err)
+	}
+}
+
+func TestPoolDraining(t *testing.T) {
+	pool := testPool(t, 4)
+	p, _ := pool.Get()
+	pool.Put(p)
+	// a CmdGoAway read after the pipe was returned
+	p.goAwayReceived()
+
+	q, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q == p || !p.IsClosed() || pool.State(p) != PoolNone {
+		t.Fatal("pipe of a remote going away handed out")
+	}
+	pool.Put(q)
+	if st := checkStats(t, pool); st.Evicted != 1 {
+		t.Fatalf("unexpected stats, %s", st)
+	}
+}
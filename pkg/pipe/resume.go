@@ -0,0 +1,750 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/log"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+// A term granted OptResume survives the loss of its connection. Every
+// CmdTrans payload then starts with the 8-byte offset of its data in the
+// stream of the term, and each side keeps the data the remote has not
+// acknowledged by CmdAck. The client re-attaches a new connection to the
+// session with a CmdResume, authenticated like a CmdConn and carrying the
+// session ID and the offset it received up to. The server answers with
+// CmdOK carrying its own offset, then both sides send the data after the
+// offset of the other.
+const SessionIDLen = 16
+const SeqLen int = 8
+
+// ResumeBufferSize bounds the data kept for retransmission, Write blocks
+// once it is full until the remote acknowledges some.
+const ResumeBufferSize = 1024 * 1024
+const ackInterval = ResumeBufferSize / 4
+
+// DefaultResumeTimeout is how long a term waits for its connection to be
+// replaced.
+const DefaultResumeTimeout = 30 * time.Second
+
+var ErrResume = errors.New("pipe resumption requested")
+var ErrSessionNotFound = errors.New("resumable session not found")
+
+type SessionID [SessionIDLen]byte
+
+func (id SessionID) String() string {
+	return fmt.Sprintf("%x", id[:4])
+}
+
+// resumeState is the resumption state of a term, guarded by wmu except
+// the fields only used by the reader. The data kept for retransmission is
+// guarded by amu instead, so that the reader processes acks without
+// waiting for writers. id, active and failed are changed under both.
+type resumeState struct {
+	id        SessionID
+	active    bool
+	amu       sync.Mutex
+	space     *sync.Cond // signaled on amu when buf has room or failed
+	buf       []byte     // sent data from offset acked
+	acked     uint64
+	sent      uint64
+	flags     uint8 // flags of the CmdTrans frames of the term
+	closeSent bool
+	gen       int        // incremented each time the connection is replaced
+	parked    bool       // the reader is waiting for a new connection
+	rmu       sync.Mutex // serializes Resume
+	failed    bool       // the connection could not be replaced
+	replaying bool
+
+	// reader only, delivered and ackedRecv are used by deliver instead
+	// while it runs
+	recv      uint64
+	delivered uint64
+	ackedRecv uint64
+	deferAck  bool
+}
+
+// resumeRequest is the content of a CmdResume.
+type resumeRequest struct {
+	id   SessionID
+	recv uint64
+}
+
+// SetRedial enables resumption on the client side of p, dial connects to
+// the server again when the connection of a resumable term is lost.
+func (p *Pipe) SetRedial(dial func() (net.Conn, error)) {
+	p.redial = dial
+}
+
+// SessionID returns the ID of the resumable term of p, if any.
+func (p *Pipe) SessionID() (SessionID, bool) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.resume.id, p.resume.active
+}
+
+// grantResume is called by the server when the client requests
+// resumption, it returns the option of the reply.
+func (p *Pipe) grantResume() []byte {
+	var id SessionID
+	rand.Read(id[:])
+	p.wmu.Lock()
+	p.resume.amu.Lock()
+	p.resume.id = id
+	p.resume.active = true
+	p.resume.amu.Unlock()
+	p.wmu.Unlock()
+	return append([]byte{OptResume, SessionIDLen}, id[:]...)
+}
+
+// applyResume is called by the client with the session ID granted.
+func (p *Pipe) applyResume(v []byte) {
+	if !p.features.Resume || p.redial == nil || len(v) != SessionIDLen {
+		return
+	}
+	p.wmu.Lock()
+	p.resume.amu.Lock()
+	copy(p.resume.id[:], v)
+	p.resume.active = true
+	p.resume.amu.Unlock()
+	p.wmu.Unlock()
+}
+
+// resetResume drops the resumption state of the finished term.
+func (p *Pipe) resetResume() {
+	p.wmu.Lock()
+	r := &p.resume
+	r.amu.Lock()
+	r.active, r.closeSent, r.failed = false, false, false
+	r.buf = nil
+	r.acked, r.sent, r.recv, r.delivered, r.ackedRecv = 0, 0, 0, 0, 0
+	r.amu.Unlock()
+	p.wmu.Unlock()
+}
+
+// sendLocked writes data as the CmdTrans frames of the term, wmu required.
+// In a resumable term the data is kept until acknowledged.
+func (p *Pipe) sendLocked(flags uint8, data []byte) (int, error) {
+	r := &p.resume
+	if !r.active {
+		for pos := 0; pos < len(data); {
+			nBytes := min(len(data)-pos, p.frameLen(MaxLen))
+			p.appendTransLocked(flags, nil, data[pos:pos+nBytes])
+			pos += nBytes
+		}
+		if err := p.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	r.flags = flags
+	for pos := 0; pos < len(data); {
+		room, err := p.waitRoomLocked()
+		if err != nil {
+			return pos, err
+		}
+
+		nBytes := min(len(data)-pos, p.frameLen(MaxLen)-SeqLen, room)
+		var seq [SeqLen]byte
+		r.amu.Lock()
+		binary.BigEndian.PutUint64(seq[:], r.sent)
+		r.buf = append(r.buf, data[pos:pos+nBytes]...)
+		r.sent += uint64(nBytes)
+		r.amu.Unlock()
+		p.appendTransLocked(flags, seq[:], data[pos:pos+nBytes])
+		pos += nBytes
+	}
+	if err := p.flushLocked(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// waitRoomLocked returns the room left in the retransmission buffer,
+// waiting for acks while there is none. The queued frames are flushed
+// first, and wmu is released while waiting.
+func (p *Pipe) waitRoomLocked() (int, error) {
+	r := &p.resume
+	for {
+		if r.failed || p.IsClosed() {
+			return 0, ErrPipe
+		}
+		r.amu.Lock()
+		room := ResumeBufferSize - len(r.buf)
+		r.amu.Unlock()
+		if room > 0 {
+			return room, nil
+		}
+		if err := p.flushLocked(); err != nil {
+			return 0, err
+		}
+
+		p.wmu.Unlock()
+		r.amu.Lock()
+		for len(r.buf) >= ResumeBufferSize && !r.failed && !p.IsClosed() {
+			r.space.Wait()
+		}
+		r.amu.Unlock()
+		p.wmu.Lock()
+	}
+}
+
+// appendTransLocked queues a CmdTrans frame, seq is the offset prefix of a
+// resumable term.
+func (p *Pipe) appendTransLocked(flags uint8, seq []byte, data []byte) {
+	hdr := [HeaderLen + ExtLenLen]byte{CmdTrans | flags, p.term}
+	hdr2 := putLength(hdr[:], HeaderLen, len(seq)+len(data))
+	if len(data) <= copyThreshold {
+		start, pad := p.appendHeaderLocked(hdr2, len(seq)+len(data))
+		p.hdrs = append(p.hdrs, seq...)
+		p.hdrs = append(p.hdrs, data...)
+		p.hdrs = append(p.hdrs, zeroPadding[:pad]...)
+		p.frames = append(p.frames, pendingFrame{start: start, end: len(p.hdrs)})
+		return
+	}
+	start, pad := p.appendHeaderLocked(hdr2, len(seq)+len(data))
+	p.hdrs = append(p.hdrs, seq...)
+	p.frames = append(p.frames, pendingFrame{start, len(p.hdrs), data, pad})
+}
+
+// replayLocked sends the data after offset from, which the remote reported
+// as received, on the new connection.
+func (p *Pipe) replayLocked(from uint64) error {
+	r := &p.resume
+	r.amu.Lock()
+	acked, sent := r.acked, r.sent
+	r.amu.Unlock()
+	if from < acked || from > sent {
+		return fmt.Errorf("[%s] cannot resume from %d, buffered: %d-%d", p, from, acked, sent)
+	}
+	p.ack(from)
+
+	// the bytes of buf are never modified, only dropped or appended to
+	r.amu.Lock()
+	off, data := r.acked, r.buf
+	r.amu.Unlock()
+	for len(data) > 0 {
+		nBytes := min(len(data), p.frameLen(MaxLen)-SeqLen)
+		var seq [SeqLen]byte
+		binary.BigEndian.PutUint64(seq[:], off)
+		p.appendTransLocked(r.flags, seq[:], data[:nBytes])
+		off += uint64(nBytes)
+		data = data[nBytes:]
+	}
+	if r.closeSent {
+		p.appendCopyLocked([]byte{CmdClose, p.term, 0, 0}, nil)
+	}
+	log.Infof("[%s] session %s resumed, replayed %d bytes", p, r.id, sent-from)
+	return p.flushLocked()
+}
+
+// ack drops the data the remote received before offset, writers waiting
+// for room are woken up. It is called by the reader, without wmu.
+func (p *Pipe) ack(offset uint64) {
+	r := &p.resume
+	r.amu.Lock()
+	defer r.amu.Unlock()
+	if offset <= r.acked || offset > r.sent {
+		return
+	}
+	r.buf = r.buf[offset-r.acked:]
+	r.acked = offset
+	r.space.Broadcast()
+}
+
+// failLocked gives up resuming the term and wakes up every waiter, wmu
+// required.
+func (p *Pipe) failLocked() {
+	r := &p.resume
+	r.amu.Lock()
+	r.failed = true
+	r.space.Broadcast()
+	r.amu.Unlock()
+	p.cond.Broadcast()
+}
+
+// wakeWriters wakes up the writers waiting for acks, to notice that p is
+// closed.
+func (p *Pipe) wakeWriters() {
+	r := &p.resume
+	r.amu.Lock()
+	r.space.Broadcast()
+	r.amu.Unlock()
+}
+
+// trans checks the offset of a CmdTrans of length bytes in a resumable
+// term, it returns the number of leading bytes already received.
+func (p *Pipe) trans(length int) (skip int, err error) {
+	if length < SeqLen {
+		return 0, fmt.Errorf("[%s] invalid frame length: %d", p, length)
+	}
+	if _, err = io.ReadFull(p.conn, p.readBuf[4:4+SeqLen]); err != nil {
+		return 0, err
+	}
+	off := binary.BigEndian.Uint64(p.readBuf[4:])
+	r := &p.resume
+	if off > r.recv {
+		return 0, fmt.Errorf("[%s] missing data, offset: %d, received: %d", p, off, r.recv)
+	}
+	return min(int(r.recv-off), length-SeqLen), nil
+}
+
+// received counts n bytes of CmdTrans payload read in a resumable term.
+// They are acknowledged at once, or by deliver once the data they carry is
+// written to the local connection.
+func (p *Pipe) received(n int) {
+	r := &p.resume
+	if !r.active {
+		return
+	}
+	r.recv += uint64(n)
+	if !r.deferAck {
+		p.delivered(r.recv)
+	}
+}
+
+// delivered acknowledges the payload up to offset off every ackInterval
+// bytes. Offsets count the payload as sent, compressed or not. Acks are
+// queued for the control writer, the writers of p may be blocked until the
+// remote reads them.
+func (p *Pipe) delivered(off uint64) {
+	r := &p.resume
+	r.delivered = off
+	if r.delivered-r.ackedRecv < ackInterval {
+		return
+	}
+	r.ackedRecv = r.delivered
+	var seq [SeqLen]byte
+	binary.BigEndian.PutUint64(seq[:], r.delivered)
+	p.queueCtl([]byte{CmdAck, p.term, 0, byte(SeqLen)}, seq[:])
+}
+
+// copyResumable copies the data of a resumable term from p to conn, and
+// acknowledges it once written to conn. The data is read ahead while conn
+// blocks: the acks of the remote may be behind it, and the writers of p
+// wait for them. The remote sends at most ResumeBufferSize bytes not
+// acknowledged, so reading ahead as much never blocks the reader.
+func (p *Pipe) copyResumable(conn net.Conn) error {
+	p.resume.deferAck = true
+	defer func() { p.resume.deferAck = false }()
+	ra := newReadAhead()
+	werrc := make(chan error, 1)
+	go func() {
+		werrc <- p.deliver(conn, ra)
+	}()
+
+	buf := make([]byte, bufSize)
+	var err error
+	for err == nil {
+		var n int
+		n, err = p.Read(buf)
+		if n > 0 && !ra.write(buf[:n], p.resume.recv) {
+			break
+		}
+	}
+	ra.close(false)
+	if werr := <-werrc; werr != nil {
+		return werr
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// deliver writes the data read ahead to conn until the reader is done. If
+// conn fails p is closed, as once readLoop fails.
+func (p *Pipe) deliver(conn net.Conn, ra *readAhead) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, off, ok := ra.read(buf)
+		if !ok {
+			return nil
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			ra.close(true)
+			p.Close()
+			return err
+		}
+		if off > 0 {
+			p.delivered(off)
+		}
+	}
+}
+
+// readAhead is the data of a resumable term read from the pipe but not yet
+// written to the local connection. Each write is marked with the payload
+// offset read so far, which differs from the length of the data once it
+// is decompressed. A compressed chunk is acknowledged with the data it
+// ends, even if the decompressor read a bit beyond it.
+type readAhead struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	marks   []readMark
+	written uint64
+	taken   uint64
+	eof     bool // the reader is done
+	aborted bool // the data is not delivered anymore
+}
+
+// readMark is the payload offset off of the data of readAhead up to end.
+type readMark struct {
+	end uint64
+	off uint64
+}
+
+func newReadAhead() *readAhead {
+	ra := &readAhead{}
+	ra.cond = sync.NewCond(&ra.mu)
+	return ra
+}
+
+// write appends b, read up to the payload offset off, waiting while
+// ResumeBufferSize bytes are pending, as only a misbehaving remote would
+// send. It returns false once aborted.
+func (ra *readAhead) write(b []byte, off uint64) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for ra.buf.Len() >= ResumeBufferSize && !ra.aborted {
+		ra.cond.Wait()
+	}
+	if ra.aborted {
+		return false
+	}
+	ra.buf.Write(b)
+	ra.written += uint64(len(b))
+	ra.marks = append(ra.marks, readMark{ra.written, off})
+	ra.cond.Broadcast()
+	return true
+}
+
+// read takes the pending data into b along with the payload offset it
+// completes, 0 if none. It returns false once the reader is done and
+// nothing is pending, or once aborted.
+func (ra *readAhead) read(b []byte) (int, uint64, bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for ra.buf.Len() == 0 && !ra.eof && !ra.aborted {
+		ra.cond.Wait()
+	}
+	if ra.aborted || ra.buf.Len() == 0 {
+		return 0, 0, false
+	}
+	n, _ := ra.buf.Read(b)
+	ra.taken += uint64(n)
+	var off uint64
+	for len(ra.marks) > 0 && ra.marks[0].end <= ra.taken {
+		off = ra.marks[0].off
+		ra.marks = ra.marks[1:]
+	}
+	ra.cond.Broadcast()
+	return n, off, true
+}
+
+// close ends the data, or drops it if abort.
+func (ra *readAhead) close(abort bool) {
+	ra.mu.Lock()
+	if abort {
+		ra.aborted = true
+	} else {
+		ra.eof = true
+	}
+	ra.cond.Broadcast()
+	ra.mu.Unlock()
+}
+
+// resumable reports whether err of the connection can be recovered from by
+// replacing it. Timeouts are not, they are the idle timeout of the pipe or
+// the end of a term.
+func (p *Pipe) resumable(err error) bool {
+	if !p.resume.active || p.IsClosed() || IsTimeoutError(err) {
+		return false
+	}
+	var opErr *net.OpError
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &opErr) || errors.Is(err, net.ErrClosed)
+}
+
+// recoverRead is called by the reader when the connection fails with err,
+// it returns true once a new connection is attached. The client dials
+// it, the server waits for the client.
+func (p *Pipe) recoverRead(err error) bool {
+	if !p.resumable(err) {
+		return false
+	}
+	// a writer blocked on the connection holds wmu
+	p.conn.Close()
+	log.Warnf("[%s] session %s lost its connection, %v", p, p.resume.id, err)
+	if p.redial != nil {
+		return p.reconnect()
+	}
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	r := &p.resume
+	if r.failed {
+		return false
+	}
+	gen := r.gen
+	r.parked = true
+	p.cond.Broadcast()
+	p.waitLocked(func() bool { return r.gen != gen || p.IsClosed() })
+	r.parked = false
+	if r.gen == gen {
+		p.failLocked()
+		return false
+	}
+	return true
+}
+
+// waitResumeLocked is called by writers when the connection fails with
+// err, it returns nil once the frames are replayed on a new connection.
+func (p *Pipe) waitResumeLocked(err error) error {
+	r := &p.resume
+	if r.replaying || !p.resumable(err) {
+		return err
+	}
+	// the reader notices the failure and replaces the connection
+	p.conn.Close()
+	gen := r.gen
+	p.waitLocked(func() bool { return r.gen != gen || r.failed || p.IsClosed() })
+	if r.gen == gen {
+		return err
+	}
+	return nil
+}
+
+// waitLocked waits on cond until done returns true or the resume timeout
+// expires, wmu required.
+func (p *Pipe) waitLocked(done func() bool) {
+	deadline := time.Now().Add(p.resumeTimeout)
+	timer := time.AfterFunc(p.resumeTimeout, func() {
+		p.wmu.Lock()
+		p.cond.Broadcast()
+		p.wmu.Unlock()
+	})
+	defer timer.Stop()
+	for !done() && time.Now().Before(deadline) {
+		p.cond.Wait()
+	}
+}
+
+// reconnect dials the server until the session is resumed or the resume
+// timeout expires.
+func (p *Pipe) reconnect() bool {
+	deadline := time.Now().Add(p.resumeTimeout)
+	backoff := 100 * time.Millisecond
+	for time.Now().Before(deadline) {
+		conn, err := p.redial()
+		if err == nil {
+			if err = p.attach(conn); err == nil {
+				return true
+			}
+			conn.Close()
+			if errors.Is(err, ErrSessionNotFound) {
+				break
+			}
+		}
+		log.Warnf("[%s] error resuming session %s, %v", p, p.resume.id, err)
+		time.Sleep(backoff)
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+
+	p.wmu.Lock()
+	p.failLocked()
+	p.wmu.Unlock()
+	return false
+}
+
+// attach sends a CmdResume on conn and replaces the connection of p with
+// it once the server accepts.
+func (p *Pipe) attach(conn net.Conn) error {
+	tmp := New(conn, p.resumeTimeout)
+	tmp.term = p.term
+	binding, err := tmp.channelBinding()
+	if err != nil {
+		return err
+	}
+	opts := make([]byte, 2+SessionIDLen+SeqLen)
+	opts[0], opts[1] = OptResume, byte(SessionIDLen+SeqLen)
+	copy(opts[2:], p.resume.id[:])
+	binary.BigEndian.PutUint64(opts[2+SessionIDLen:], p.resume.recv)
+	frame, err := handShakeFrame(CmdResume, p.term, nil, p.user, p.secret, opts, binding)
+	if err != nil {
+		return err
+	}
+	if err := tmp.writeCmd(frame); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	n, err := tmp.Read(buf)
+	if err != nil {
+		return err
+	}
+	if buf[0] == CmdErr {
+		return ErrSessionNotFound
+	}
+	peer, err := resumeOffset(buf[HeaderLen:n])
+	if buf[0] != CmdOK || err != nil {
+		return fmt.Errorf("%w, invalid resume reply, cmd: %d", ErrHandShake, buf[0])
+	}
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.replaceConnLocked(conn)
+	return p.resumeLocked(peer, nil)
+}
+
+// replaceConnLocked switches p to conn, the reader must not be reading.
+func (p *Pipe) replaceConnLocked(conn net.Conn) {
+	p.conn = conn
+	p.ctl.setConn(conn)
+	p.vectored = vectored(conn)
+	p.n, p.pad = 0, 0
+	p.bindOnce = sync.Once{}
+	p.binding, p.bindErr = nil, nil
+	p.setDeadLine()
+}
+
+// resumeLocked replays the data after offset peer, reply is written first
+// if not nil. Waiters are woken up whatever the outcome.
+func (p *Pipe) resumeLocked(peer uint64, reply []byte) error {
+	r := &p.resume
+	r.replaying = true
+	var err error
+	if reply != nil {
+		p.appendCopyLocked(reply[:HeaderLen], reply[HeaderLen:])
+	}
+	err = p.replayLocked(peer)
+	r.replaying = false
+	r.gen += 1
+	p.cond.Broadcast()
+	return err
+}
+
+// Resume is called by the server with the pipe of the resumable term
+// requested by the CmdResume tmp received, tmp returned ErrResume. The
+// connection of tmp replaces the one of p.
+func (p *Pipe) Resume(tmp *Pipe) error {
+	req := tmp.resumeReq
+	r := &p.resume
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	// the session is checked under amu, a writer blocked on the connection
+	// holds wmu
+	r.amu.Lock()
+	found := r.active && !r.failed && r.id == req.id
+	r.amu.Unlock()
+	if !found || p.user != tmp.user {
+		return ErrSessionNotFound
+	}
+	// connections are only replaced under rmu, the old one is closed
+	// before taking wmu
+	p.conn.Close()
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if !r.active || r.failed || r.id != req.id || p.user != tmp.user {
+		return ErrSessionNotFound
+	}
+	// wait for the reader to notice the old connection is gone
+	p.waitLocked(func() bool { return r.parked || r.failed })
+	if !r.parked {
+		return ErrSessionNotFound
+	}
+
+	p.replaceConnLocked(tmp.conn)
+	reply := []byte{CmdOK, p.term, 0, byte(2 + SeqLen), OptResume, byte(SeqLen), 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(reply[HeaderLen+2:], r.recv)
+	return p.resumeLocked(req.recv, reply)
+}
+
+// RejectResume tells the client of tmp the session is gone.
+func (tmp *Pipe) RejectResume() error {
+	return tmp.writeCmd([]byte{CmdErr, tmp.term, 0, 1, byte(socks.ErrGeneralFailure)})
+}
+
+func parseResumeRequest(opts []byte) (resumeRequest, error) {
+	var req resumeRequest
+	m, err := parseOptions(opts)
+	if err != nil {
+		return req, err
+	}
+	v, ok := m[OptResume]
+	if !ok || len(v) != SessionIDLen+SeqLen {
+		return req, fmt.Errorf("%w, invalid resume request", ErrHandShake)
+	}
+	copy(req.id[:], v)
+	req.recv = binary.BigEndian.Uint64(v[SessionIDLen:])
+	return req, nil
+}
+
+func resumeOffset(opts []byte) (uint64, error) {
+	m, err := parseOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := m[OptResume]
+	if !ok || len(v) != SeqLen {
+		return 0, fmt.Errorf("%w, missing resume offset", ErrHandShake)
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// ResumeTable finds the resumable terms of a server by session ID.
+type ResumeTable struct {
+	mu    sync.Mutex
+	pipes map[SessionID]*Pipe
+}
+
+func NewResumeTable() *ResumeTable {
+	return &ResumeTable{pipes: make(map[SessionID]*Pipe)}
+}
+
+// Add registers p if its current term is resumable, until remove is
+// called at the end of the term.
+func (t *ResumeTable) Add(p *Pipe) (remove func()) {
+	id, ok := p.SessionID()
+	if !ok {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.pipes[id] = p
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.pipes, id)
+		t.mu.Unlock()
+	}
+}
+
+// Resume attaches the connection of tmp, which returned ErrResume, to the
+// session it requested. The CmdResume is rejected if the session is gone.
+func (t *ResumeTable) Resume(tmp *Pipe) error {
+	t.mu.Lock()
+	p := t.pipes[tmp.resumeReq.id]
+	t.mu.Unlock()
+	if p == nil || p.user != tmp.user {
+		tmp.RejectResume()
+		return ErrSessionNotFound
+	}
+	if err := p.Resume(tmp); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			tmp.RejectResume()
+		}
+		return err
+	}
+	return nil
+}
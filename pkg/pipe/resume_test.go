@@ -0,0 +1,300 @@
+package pipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/socks"
+)
+
+// randomData returns n bytes of data that compress poorly.
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// smallBuffers shrinks the socket buffers of conn, so that writers block
+// after 64 KiB not read by the remote.
+func smallBuffers(t *testing.T, conn net.Conn) {
+	tc := conn.(*net.TCPConn)
+	if err := tc.SetReadBuffer(64 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetWriteBuffer(64 * 1024); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resumablePair returns both ends of a resumable term over TCP, without
+// handshake nor redial.
+func resumablePair(t *testing.T) (*Pipe, *Pipe) {
+	c, s := tcpPair(t)
+	smallBuffers(t, c)
+	smallBuffers(t, s)
+	a, b := New(c, 0), New(s, 0)
+	b.grantResume()
+	id, _ := b.SessionID()
+	a.resume.id, a.resume.active = id, true
+	return a, b
+}
+
+// transfer writes data to p in chunks while another goroutine reads as
+// much from p, it returns what was read. The reader goes on reading the
+// acks of the remote.
+func transfer(p *Pipe, data []byte) (<-chan []byte, <-chan error) {
+	read := make(chan []byte, 1)
+	errc := make(chan error, 2)
+	go func() {
+		for pos := 0; pos < len(data); pos += 32 * 1024 {
+			if _, err := p.Write(data[pos:min(pos+32*1024, len(data))]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(p, buf); err != nil {
+			errc <- err
+			return
+		}
+		read <- buf
+		io.Copy(ioutil.Discard, p)
+	}()
+	return read, errc
+}
+
+// echoServer returns the address of a TCP server writing back what it
+// reads.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func waitTransfer(t *testing.T, read <-chan []byte, errc <-chan error, want []byte) {
+	t.Helper()
+	select {
+	case got := <-read:
+		if !bytes.Equal(got, want) {
+			t.Fatal("data corrupted")
+		}
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(20 * time.Second):
+		t.Fatal("transfer stalled")
+	}
+}
+
+func TestAck(t *testing.T) {
+	p := New(nil, 0)
+	r := &p.resume
+	r.buf, r.sent = make([]byte, 100), 100
+
+	p.ack(40)
+	if r.acked != 40 || len(r.buf) != 60 {
+		t.Fatalf("acked %d, buffered %d", r.acked, len(r.buf))
+	}
+	// stale and impossible offsets are ignored
+	p.ack(30)
+	p.ack(101)
+	if r.acked != 40 || len(r.buf) != 60 {
+		t.Fatalf("acked %d, buffered %d", r.acked, len(r.buf))
+	}
+	p.ack(100)
+	if r.acked != 100 || len(r.buf) != 0 {
+		t.Fatalf("acked %d, buffered %d", r.acked, len(r.buf))
+	}
+}
+
+// TestResumeBidirectional sends more than the retransmission buffer both
+// ways at once over connections with small buffers. The writers of both
+// sides block on their connection, the readers must keep reading and
+// acknowledging meanwhile.
+func TestResumeBidirectional(t *testing.T) {
+	a, b := resumablePair(t)
+	data := randomData(32 * 1024 * 1024)
+	readA, errA := transfer(a, data)
+	readB, errB := transfer(b, data)
+	waitTransfer(t, readA, errA, data)
+	waitTransfer(t, readB, errB, data)
+
+	for _, p := range []*Pipe{a, b} {
+		p.resume.amu.Lock()
+		buffered, acked := len(p.resume.buf), p.resume.acked
+		p.resume.amu.Unlock()
+		if buffered > ResumeBufferSize || acked < uint64(len(data)-ResumeBufferSize) {
+			t.Fatalf("[%s] buffered %d, acked %d", p, buffered, acked)
+		}
+	}
+}
+
+func TestResumeUnknownSession(t *testing.T) {
+	a, b := resumablePair(t)
+	tmp := New(nil, 0)
+	tmp.resumeReq.id[0] = ^b.resume.id[0]
+	if err := b.Resume(tmp); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("resumed an unknown session, %v", err)
+	}
+
+	// the connection of b is left alone
+	data := randomData(1024)
+	go b.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(a, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("connection broken by a rejected resumption, %v", err)
+	}
+}
+
+// resumeServer accepts pipes on l, binding their term to an echo server
+// as a server would to its target, and resumes them when their connection
+// is lost. conns are the connections accepted, latest last.
+type resumeServer struct {
+	l      net.Listener
+	echo   string
+	keys   auth.Keys
+	nonces *NonceCache
+	table  *ResumeTable
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+func newResumeServer(t *testing.T) *resumeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &resumeServer{
+		l:      l,
+		echo:   echoServer(t),
+		keys:   auth.Secret("secret"),
+		nonces: NewNonceCache(0),
+		table:  NewResumeTable(),
+	}
+	t.Cleanup(func() {
+		l.Close()
+		s.mu.Lock()
+		for _, c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *resumeServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*net.TCPConn).SetReadBuffer(64 * 1024)
+		conn.(*net.TCPConn).SetWriteBuffer(64 * 1024)
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *resumeServer) handle(conn net.Conn) {
+	p := New(conn, 0)
+	_, _, err := p.WaitForHandShake(s.keys, s.nonces)
+	if err == ErrResume {
+		s.table.Resume(p)
+		return
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	tgt, err := net.Dial("tcp", s.echo)
+	if err != nil || p.Confirm() != nil {
+		conn.Close()
+		return
+	}
+	defer s.table.Add(p)()
+	p.Bind(tgt)
+}
+
+// kill closes the latest connection, as if the network dropped it.
+func (s *resumeServer) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[len(s.conns)-1].Close()
+}
+
+// dialResumable opens a resumable term to s, requesting f besides
+// resumption.
+func dialResumable(t *testing.T, s *resumeServer, f Features) *Pipe {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", s.l.Addr().String())
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallBuffers(t, conn)
+	p := New(conn, 0)
+	t.Cleanup(func() { p.Close() })
+	f.Resume = true
+	p.SetFeatures(f)
+	p.SetRedial(dial)
+	if err := p.HandShake(socks.ParseAddr("127.0.0.1:80"), "", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WaitForReply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.SessionID(); !ok {
+		t.Fatal("resumption not granted")
+	}
+	return p
+}
+
+// TestResumeEcho sends data through a server bound to an echo server,
+// the data and acks of both directions share connections with small
+// buffers.
+func TestResumeEcho(t *testing.T) {
+	p := dialResumable(t, newResumeServer(t), Features{})
+	data := randomData(32 * 1024 * 1024)
+	read, errc := transfer(p, data)
+	waitTransfer(t, read, errc, data)
+}
+
+func TestResumeAfterConnectionLoss(t *testing.T) {
+	s := newResumeServer(t)
+	p := dialResumable(t, s, Features{})
+	data := randomData(8 * 1024 * 1024)
+	read, errc := transfer(p, data)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		s.kill()
+	}
+	waitTransfer(t, read, errc, data)
+}
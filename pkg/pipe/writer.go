@@ -0,0 +1,269 @@
+package pipe
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// zeroPadding is the content of every padding, it is never written to.
+var zeroPadding = make([]byte, bufSize+PadLenLen)
+
+// maxPendingCtl bounds the control frames waiting for the control writer,
+// pings beyond it are not answered, as if they were lost. Window updates are
+// never dropped, they are bounded by the window granted to the remote.
+const maxPendingCtl = 8
+
+// copyThreshold is the largest payload copied next to its header rather
+// than written as a buffer of its own.
+const copyThreshold = 2048
+
+// ctlQueue holds the control frames of the reader until the control writer
+// sends them. The reader must not wait for wmu: a writer blocked on the
+// connection holds it, and the remote may only unblock it once it reads
+// what the reader answers.
+type ctlQueue struct {
+	mu      sync.Mutex
+	conn    net.Conn // the connection of the pipe, replaced on resumption
+	frames  [][]byte
+	ack     []byte // only the latest ack is sent
+	running bool
+}
+
+func (q *ctlQueue) setConn(conn net.Conn) {
+	q.mu.Lock()
+	q.conn = conn
+	q.mu.Unlock()
+}
+
+// pendingFrame is a frame appended but not yet flushed. Its header, or the
+// whole frame if payload is nil, is hdrs[start:end] of the pipe.
+type pendingFrame struct {
+	start   int
+	end     int
+	payload []byte
+	pad     int
+}
+
+// vectored reports whether conn writes net.Buffers with a single writev,
+// other connections, TLS included, would turn every buffer into a write
+// of its own.
+func vectored(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// putLength sets the payload length n in hdr, a header of hdrLen bytes
+// followed by room for the extended length, and returns the header to
+// write.
+func putLength(hdr []byte, hdrLen int, n int) []byte {
+	binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	if n <= 0xffff {
+		return hdr[:hdrLen]
+	}
+	hdr[0] |= FlagExtLen
+	binary.BigEndian.PutUint16(hdr[hdrLen:], uint16(n>>16))
+	return hdr[:hdrLen+ExtLenLen]
+}
+
+// writeFrame writes hdr and payload as one frame, padded if negotiated.
+// hdr is the frame header without magic, extended length included.
+func (p *Pipe) writeFrame(hdr []byte, payload []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.writeFrameLocked(hdr, payload)
+}
+
+func (p *Pipe) writeFrameLocked(hdr []byte, payload []byte) error {
+	p.appendFrameLocked(hdr, payload)
+	return p.flushLocked()
+}
+
+// writeCmd writes a frame given as header and payload, which is copied.
+func (p *Pipe) writeCmd(b []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.appendCopyLocked(b[:HeaderLen], b[HeaderLen:])
+	return p.flushLocked()
+}
+
+// appendFrameLocked queues a frame. Its header is copied to the shared
+// scratch space, large payloads are referenced until the next flush. They
+// are only written without a copy on vectored connections, see
+// writeOutLocked.
+func (p *Pipe) appendFrameLocked(hdr []byte, payload []byte) {
+	if len(payload) <= copyThreshold {
+		p.appendCopyLocked(hdr, payload)
+		return
+	}
+	start, pad := p.appendHeaderLocked(hdr, len(payload))
+	p.frames = append(p.frames, pendingFrame{start, len(p.hdrs), payload, pad})
+}
+
+// appendCopyLocked queues a frame copied entirely to the scratch space.
+func (p *Pipe) appendCopyLocked(hdr []byte, payload []byte) {
+	start, pad := p.appendHeaderLocked(hdr, len(payload))
+	p.hdrs = append(p.hdrs, payload...)
+	p.hdrs = append(p.hdrs, zeroPadding[:pad]...)
+	p.frames = append(p.frames, pendingFrame{start: start, end: len(p.hdrs)})
+}
+
+func (p *Pipe) appendHeaderLocked(hdr []byte, n int) (start int, pad int) {
+	start = len(p.hdrs)
+	p.hdrs = append(p.hdrs, Magic...)
+	p.hdrs = append(p.hdrs, hdr...)
+	if p.padding != PadNone {
+		pad = p.padLen(MagicLen + len(hdr) + n)
+		p.hdrs[start+MagicLen] |= FlagPadded
+		p.hdrs = append(p.hdrs, byte(pad>>8), byte(pad))
+	}
+	return start, pad
+}
+
+// flushLocked writes the queued frames, waiting for the connection to be
+// replaced if it fails in a resumable term.
+func (p *Pipe) flushLocked() error {
+	if err := p.writeOutLocked(); err != nil {
+		return p.waitResumeLocked(err)
+	}
+	return nil
+}
+
+// queueCtl queues a control frame from the reader, to be written by the
+// control writer without taking wmu. The frame is written by a single
+// Write, connections do not interleave it with the frames of writers. A
+// CmdAck replaces the one not sent yet, a CmdWindow is always queued.
+func (p *Pipe) queueCtl(hdr []byte, payload []byte) {
+	f := p.ctlFrame(hdr, payload)
+	q := &p.ctl
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case hdr[0]&CmdMask == CmdAck:
+		q.ack = f
+	case len(q.frames) >= maxPendingCtl && hdr[0]&CmdMask != CmdWindow:
+		return
+	default:
+		q.frames = append(q.frames, f)
+	}
+	if !q.running {
+		q.running = true
+		go p.ctlLoop()
+	}
+}
+
+// ctlFrame returns hdr and payload as a frame, padded if negotiated.
+func (p *Pipe) ctlFrame(hdr []byte, payload []byte) []byte {
+	pad := 0
+	b := make([]byte, 0, MagicLen+len(hdr)+PadLenLen+len(payload))
+	b = append(b, Magic...)
+	b = append(b, hdr...)
+	if p.padding != PadNone {
+		pad = p.padLen(MagicLen + len(hdr) + len(payload))
+		b[MagicLen] |= FlagPadded
+		b = append(b, byte(pad>>8), byte(pad))
+	}
+	b = append(b, payload...)
+	return append(b, zeroPadding[:pad]...)
+}
+
+// ctlLoop is the control writer, it exits once the queue is empty. The
+// connection is closed on error so that the reader notices it.
+func (p *Pipe) ctlLoop() {
+	q := &p.ctl
+	for {
+		q.mu.Lock()
+		var f []byte
+		switch {
+		case len(q.frames) > 0:
+			f = q.frames[0]
+			q.frames = q.frames[1:]
+		case q.ack != nil:
+			f, q.ack = q.ack, nil
+		default:
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		conn := q.conn
+		q.mu.Unlock()
+
+		atomic.StoreInt64(&p.lastWrite, time.Now().UnixNano())
+		if _, err := conn.Write(f); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// writeOutLocked writes the queued frames. With a connection supporting it
+// they are written by a single writev, runs of frames in the scratch space
+// being one buffer, and payloads are not copied. Otherwise, as with TLS,
+// each frame is copied to writeBuf and written on its own, so that a full
+// frame fills a TLS record rather than being split in two.
+func (p *Pipe) writeOutLocked() error {
+	defer func() {
+		for i := range p.frames {
+			p.frames[i].payload = nil
+		}
+		p.frames = p.frames[:0]
+		p.hdrs = p.hdrs[:0]
+	}()
+	atomic.StoreInt64(&p.lastWrite, time.Now().UnixNano())
+
+	if !p.vectored {
+		for _, f := range p.frames {
+			buf := p.hdrs[f.start:f.end]
+			if f.payload != nil {
+				buf = append(p.writeBuf[:0], buf...)
+				buf = append(buf, f.payload...)
+				buf = append(buf, zeroPadding[:f.pad]...)
+				p.writeBuf = buf
+			}
+			if _, err := p.conn.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	p.bufs = p.bufs[:0]
+	seg := 0
+	for _, f := range p.frames {
+		if f.payload == nil {
+			continue
+		}
+		p.bufs = append(p.bufs, p.hdrs[seg:f.end], f.payload)
+		if f.pad > 0 {
+			p.bufs = append(p.bufs, zeroPadding[:f.pad])
+		}
+		seg = f.end
+	}
+	if seg < len(p.hdrs) {
+		p.bufs = append(p.bufs, p.hdrs[seg:])
+	}
+	if len(p.bufs) == 1 {
+		_, err := p.conn.Write(p.bufs[0])
+		return err
+	}
+	// WriteTo consumes the slice it is called on
+	p.wbufs = p.bufs
+	_, err := p.wbufs.WriteTo(p.conn)
+	return err
+}
+
+// copyToFrames copies src to dst, which writes frames of up to frameLen
+// bytes, reading as much as a frame holds when it is larger than the
+// buffer io.Copy would use.
+func copyToFrames(dst io.Writer, src io.Reader, frameLen int) (int64, error) {
+	if frameLen <= 32*1024 {
+		return io.Copy(dst, src)
+	}
+	// hide io.WriterTo of src, it would not use the buffer
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, make([]byte, frameLen))
+}
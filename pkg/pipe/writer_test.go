@@ -0,0 +1,241 @@
+package pipe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (client, server net.Conn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// tlsPair returns both ends of a TLS connection over loopback TCP,
+// handshaked.
+func tlsPair(tb testing.TB) (client, server net.Conn) {
+	tb.Helper()
+	c, s := tcpPair(tb)
+	crt := testCertificate(tb)
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	ts := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{crt}})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ts.Handshake()
+	}()
+	if err := tc.Handshake(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		tb.Fatal(err)
+	}
+	return tc, ts
+}
+
+func testCertificate(tb testing.TB) tls.Certificate {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// benchmarkWrite measures Pipe.Write of size bytes on conn, whose remote
+// end discards everything. copied forces the path writing each frame on
+// its own after copying it, the only one before vectored writes.
+func benchmarkWrite(b *testing.B, pair func(testing.TB) (net.Conn, net.Conn), size int, copied bool) {
+	c, s := pair(b)
+	go io.Copy(ioutil.Discard, s)
+	p := New(c, 0)
+	if copied {
+		p.vectored = false
+	}
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var writeSizes = []int{1024, 16 * 1024, 64 * 1024}
+
+func BenchmarkWriteTCPVectored(b *testing.B) {
+	for _, size := range writeSizes {
+		b.Run(fmt.Sprintf("%dK", size/1024), func(b *testing.B) {
+			benchmarkWrite(b, tcpPair, size, false)
+		})
+	}
+}
+
+func BenchmarkWriteTCPCopied(b *testing.B) {
+	for _, size := range writeSizes {
+		b.Run(fmt.Sprintf("%dK", size/1024), func(b *testing.B) {
+			benchmarkWrite(b, tcpPair, size, true)
+		})
+	}
+}
+
+func BenchmarkWriteTLS(b *testing.B) {
+	for _, size := range writeSizes {
+		b.Run(fmt.Sprintf("%dK", size/1024), func(b *testing.B) {
+			benchmarkWrite(b, tlsPair, size, false)
+		})
+	}
+}
+
+// baselineWrite is Pipe.Write as it was before frames were queued: each
+// frame is copied next to its header into writeBuf and written on its own.
+// Padding and compression are left out.
+func baselineWrite(p *Pipe, b []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.setDeadLine()
+	for pos := 0; pos < len(b); {
+		nBytes := min(len(b)-pos, MaxLen)
+		hdr := [HeaderLen]byte{CmdTrans, p.term, byte(nBytes >> 8), byte(nBytes % 256)}
+		buf := append(p.writeBuf[:0], Magic...)
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, b[pos:pos+nBytes]...)
+		p.writeBuf = buf
+		atomic.StoreInt64(&p.lastWrite, time.Now().UnixNano())
+		if _, err := p.conn.Write(buf); err != nil {
+			return err
+		}
+		pos += nBytes
+	}
+	return nil
+}
+
+// BenchmarkWriteTLSBaseline is the reference of BenchmarkWriteTLS, TLS
+// connections are not vectored so both copy every payload.
+func BenchmarkWriteTLSBaseline(b *testing.B) {
+	for _, size := range writeSizes {
+		b.Run(fmt.Sprintf("%dK", size/1024), func(b *testing.B) {
+			c, s := tlsPair(b)
+			go io.Copy(ioutil.Discard, s)
+			p := New(c, 0)
+			buf := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := baselineWrite(p, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteCmd(b *testing.B) {
+	c, s := tcpPair(b)
+	go io.Copy(ioutil.Discard, s)
+	p := New(c, 0)
+	frame := []byte{CmdPing, 0, 0, 0}
+	b.SetBytes(int64(MagicLen + len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.writeCmd(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestWritePadBucketLargeFrames checks that frames up to the negotiated
+// length are padded to a bucket, the largest one repeated past it.
+func TestWritePadBucketLargeFrames(t *testing.T) {
+	c, s := tcpPair(t)
+	p := New(c, 0)
+	p.grant(PadBucket, CompressNone, MaxFrameLimit)
+	last := padBuckets[len(padBuckets)-1]
+	sizes := []int{100, 20000, 100000, MaxFrameLimit}
+	go func() {
+		for _, size := range sizes {
+			p.Write(randomData(size))
+		}
+	}()
+
+	var raw []byte
+	buf := make([]byte, 64*1024)
+	for _, size := range sizes {
+		for got := 0; got < size; {
+			var f Frame
+			n, err := 0, error(nil)
+			if len(raw) > MagicLen {
+				n, err = f.Decode(raw[MagicLen:])
+			}
+			if n == 0 {
+				if err != nil && !errors.Is(err, ErrShortFrame) {
+					t.Fatal(err)
+				}
+				m, err := s.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw = append(raw, buf[:m]...)
+				continue
+			}
+			total := MagicLen + n
+			padded := total%last == 0
+			for _, b := range padBuckets {
+				padded = padded || total == b
+			}
+			if !padded {
+				t.Fatalf("frame of %d bytes, payload %d, not padded to a bucket", total, len(f.Payload))
+			}
+			got += len(f.Payload)
+			raw = raw[total:]
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// DefaultCrtPath and DefaultKeyPath are where a self-signed certificate is
+// persisted when neither ServerOption.CrtPath nor KeyPath is set.
+const (
+	DefaultCrtPath = "sproxy-cert.pem"
+	DefaultKeyPath = "sproxy-key.pem"
+)
+
+// certWatchInterval is how often the certificate files are checked for
+// changes.
+const certWatchInterval = 10 * time.Second
+
+// selfSignedValidity is the validity of generated certificates, clients
+// pin their public key rather than trusting them.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// certificate is the server certificate, reloaded from its files on
+// change. Pipes already established keep the certificate they were
+// handshaked with.
+type certificate struct {
+	crtPath string
+	keyPath string
+	mu      sync.RWMutex
+	crt     *tls.Certificate
+	stamp   string
+}
+
+// loadCertificate loads the certificate at crtPath and keyPath, a
+// self-signed one is generated at the default paths if both are empty.
+func loadCertificate(crtPath, keyPath string) (*certificate, error) {
+	if (crtPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("error loading certificate, both or neither of the certificate and key must be set")
+	}
+	c := &certificate{crtPath: crtPath, keyPath: keyPath}
+	if crtPath == "" {
+		c.crtPath, c.keyPath = DefaultCrtPath, DefaultKeyPath
+		if _, err := os.Stat(c.crtPath); os.IsNotExist(err) {
+			if err := generateCertificate(c.crtPath, c.keyPath); err != nil {
+				return nil, fmt.Errorf("error generating certificate, %v", err)
+			}
+			log.Infof("generated a self-signed certificate at %s and %s", c.crtPath, c.keyPath)
+		}
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the files again, the current certificate is kept on error.
+func (c *certificate) reload() error {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return fmt.Errorf("error loading certificate, %v", err)
+	}
+	crt, err := tls.LoadX509KeyPair(c.crtPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("error loading certificate, %v", err)
+	}
+	leaf, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error loading certificate, %v", err)
+	}
+	crt.Leaf = leaf
+
+	c.mu.Lock()
+	c.crt = &crt
+	c.stamp = stamp
+	c.mu.Unlock()
+	log.Infof("loaded certificate %s, %s, public key pin: %s", c.crtPath, leaf.Subject, auth.PublicKeyPin(leaf))
+	return nil
+}
+
+// fileStamp identifies the version of the files by their size and
+// modification time.
+func (c *certificate) fileStamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{c.crtPath, c.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d-%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// get is the GetCertificate of the TLS config.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.crt, nil
+}
+
+// reloadChanged reloads the files if they changed since the last load.
+func (c *certificate) reloadChanged() {
+	stamp, err := c.fileStamp()
+	c.mu.RLock()
+	changed := err == nil && stamp != c.stamp
+	c.mu.RUnlock()
+	if !changed {
+		return
+	}
+	// the files may be half written, retried on the next tick
+	if err := c.reload(); err != nil {
+		log.Warnf("certificate not reloaded, %v", err)
+	}
+}
+
+// KeyPair is the paths of a certificate and its key.
+type KeyPair struct {
+	CrtPath string
+	KeyPath string
+}
+
+// certificates selects a certificate by the SNI of clients, the default
+// one is used for unknown names and clients sending none.
+type certificates struct {
+	def *certificate
+	sni []*certificate
+}
+
+func loadCertificates(crtPath, keyPath string, pairs []KeyPair) (*certificates, error) {
+	def, err := loadCertificate(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cs := &certificates{def: def}
+	for _, pair := range pairs {
+		if pair.CrtPath == "" || pair.KeyPath == "" {
+			return nil, fmt.Errorf("error loading certificate, both the certificate and key of SNI certificates must be set")
+		}
+		c, err := loadCertificate(pair.CrtPath, pair.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		cs.sni = append(cs.sni, c)
+	}
+	return cs, nil
+}
+
+// get is the GetCertificate of the TLS config, the first certificate
+// valid for the SNI is selected.
+func (cs *certificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		for _, c := range cs.sni {
+			crt, _ := c.get(hello)
+			if crt.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return crt, nil
+			}
+		}
+	}
+	return cs.def.get(hello)
+}
+
+func (cs *certificates) reload() error {
+	if err := cs.def.reload(); err != nil {
+		return err
+	}
+	for _, c := range cs.sni {
+		if err := c.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch reloads the certificates whose files change, until stop is closed.
+func (cs *certificates) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		cs.def.reloadChanged()
+		for _, c := range cs.sni {
+			c.reloadChanged()
+		}
+	}
+}
+
+// generateCertificate writes a self-signed ECDSA certificate and its key.
+func generateCertificate(crtPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	name := "sproxy"
+	if host, err := os.Hostname(); err == nil {
+		name = host
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// the key first, a certificate without its key would not be generated
+	// again
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
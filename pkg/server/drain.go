@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/log"
+	"github.com/iberryful/sproxy/pkg/pipe"
+)
+
+// DefaultGracePeriod is how long Shutdown waits for active connections when
+// ServerOption.GracePeriod is not set.
+const DefaultGracePeriod = 30 * time.Second
+
+// drain tracks the pipes and sessions of a server and its active
+// connections, so that Shutdown can tell clients to go away and wait for
+// the connections to finish.
+type drain struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	draining bool
+	active   int
+	pipes    map[*pipe.Pipe]struct{}
+	sessions map[*pipe.Session]struct{}
+}
+
+func newDrain() *drain {
+	d := &drain{
+		pipes:    make(map[*pipe.Pipe]struct{}),
+		sessions: make(map[*pipe.Session]struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *drain) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// addPipe tracks p until the returned function is called, it returns false
+// if the server is shutting down.
+func (d *drain) addPipe(p *pipe.Pipe) (func(), bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return func() {}, false
+	}
+	d.pipes[p] = struct{}{}
+	return func() {
+		d.mu.Lock()
+		delete(d.pipes, p)
+		d.mu.Unlock()
+	}, true
+}
+
+// addSession tracks sess until the returned function is called. The pipe of
+// sess must no longer be tracked, frames of sess are multiplexed.
+func (d *drain) addSession(sess *pipe.Session) (remove func()) {
+	d.mu.Lock()
+	d.sessions[sess] = struct{}{}
+	draining := d.draining
+	d.mu.Unlock()
+	if draining {
+		sess.GoAway()
+	}
+	return func() {
+		d.mu.Lock()
+		delete(d.sessions, sess)
+		d.mu.Unlock()
+	}
+}
+
+// begin counts a new connection, it returns false if the server is
+// shutting down.
+func (d *drain) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.active += 1
+	return true
+}
+
+func (d *drain) done() {
+	d.mu.Lock()
+	d.active -= 1
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// goAway starts draining, a CmdGoAway is sent on every pipe and session.
+// They are sent asynchronously, connections refused meanwhile send their
+// own first.
+func (d *drain) goAway() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+	for p := range d.pipes {
+		// a resumable pipe may be waiting for its connection
+		go p.GoAway()
+	}
+	for sess := range d.sessions {
+		go sess.GoAway()
+	}
+}
+
+// wait waits up to grace for the active connections to finish, then closes
+// every pipe and session.
+func (d *drain) wait(grace time.Duration) {
+	d.mu.Lock()
+	log.Infof("draining %d connections for up to %s", d.active, grace)
+	deadline := time.Now().Add(grace)
+	timer := time.AfterFunc(grace, func() {
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	})
+	defer timer.Stop()
+	for d.active > 0 && time.Now().Before(deadline) {
+		d.cond.Wait()
+	}
+	if d.active > 0 {
+		log.Warnf("closing %d connections after the grace period", d.active)
+	}
+
+	pipes, sessions := d.pipes, d.sessions
+	d.pipes = make(map[*pipe.Pipe]struct{})
+	d.sessions = make(map[*pipe.Session]struct{})
+	d.mu.Unlock()
+	for p := range pipes {
+		p.Close()
+	}
+	for sess := range sessions {
+		sess.Close()
+	}
+}
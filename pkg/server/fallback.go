@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// maxRecordLen bounds the bytes kept for the fallback, handshakes are far
+// smaller than this.
+const maxRecordLen = 64 * 1024
+
+// recordConn keeps what is read from Conn until the peer is authenticated,
+// so that it can be replayed to the fallback.
+type recordConn struct {
+	net.Conn
+	buf       []byte
+	recording bool
+}
+
+func newRecordConn(conn net.Conn) *recordConn {
+	return &recordConn{Conn: conn, recording: true}
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording {
+		if len(c.buf)+n > maxRecordLen {
+			c.stop()
+		} else {
+			c.buf = append(c.buf, b[:n]...)
+		}
+	}
+	return n, err
+}
+
+// ConnectionState exposes the TLS state of Conn for channel binding.
+func (c *recordConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.Conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// stop stops recording, it must be called before reading from another
+// goroutine.
+func (c *recordConn) stop() {
+	c.recording = false
+	c.buf = nil
+}
+
+// replayable reports whether every byte read so far is recorded.
+func (c *recordConn) replayable() bool {
+	return c.recording
+}
+
+// fallback splices conn to the fallback backend, replaying the bytes already
+// read, so that unauthenticated peers see an ordinary website.
+func (s *Server) fallback(conn *recordConn) {
+	f, err := net.Dial("tcp", s.option.Fallback)
+	if err != nil {
+		log.Errorf("fallback %s failed, %s", s.option.Fallback, err)
+		return
+	}
+	defer f.Close()
+
+	buf := conn.buf
+	conn.stop()
+	if _, err := f.Write(buf); err != nil {
+		return
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		io.Copy(f, conn)
+		if c, ok := f.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		close(ch)
+	}()
+	io.Copy(conn, f)
+	conn.Close()
+	<-ch
+}
+
+// fallbackHandler proxies the requests HTTP based transports do not upgrade
+// to the fallback backend, nil if there is none.
+func (s *Server) fallbackHandler() http.Handler {
+	if s.option.Fallback == "" {
+		return nil
+	}
+	return httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: s.option.Fallback})
+}
@@ -1,51 +1,166 @@
 package server
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/iberryful/sproxy/pkg/auth"
 	"github.com/iberryful/sproxy/pkg/log"
 	"github.com/iberryful/sproxy/pkg/pipe"
+	"github.com/iberryful/sproxy/pkg/socks"
+	"github.com/iberryful/sproxy/pkg/transport"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 type ServerOption struct {
+	// KeyPath and CrtPath are the server certificate, reloaded when the
+	// files change. A self-signed certificate is generated at
+	// DefaultKeyPath and DefaultCrtPath if neither is set.
 	KeyPath string
 	CrtPath string
-	Secret  string
-	Listen  string
+	// Certificates are selected by the SNI of clients against their names,
+	// the certificate of CrtPath is used for other names.
+	Certificates []KeyPair
+	Secret       string
+	UsersPath    string
+	Listen       string
+	Window       uint32
+	// ClientCAPath enables mutual TLS, client certificates must chain to it.
+	// The subject of the client certificate becomes the user identity.
+	ClientCAPath string
+	// CRLPath is a CRL signed by the client CA, reloaded by Reload.
+	CRLPath string
+	// Fallback is the address connections failing the magic or handshake
+	// check are spliced to, such as a local web server.
+	Fallback string
+	// MaxFrameSize caps the frame payload clients may negotiate, 0 means
+	// pipe.MaxFrameLimit.
+	MaxFrameSize int
+	// Allow decides whether user may connect to addr, nil allows everything.
+	Allow func(user string, addr socks.Addr) bool
+	// GracePeriod is how long Shutdown waits for active connections before
+	// closing them, 0 means DefaultGracePeriod.
+	GracePeriod time.Duration
+	// Transport is the name of the transport pipes are accepted with, see
+	// package transport, "" means TLS.
+	Transport string
+	// Path is the request path of HTTP based transports, "/" by default.
+	// Other requests are proxied to Fallback.
+	Path string
+	// Camouflage, if set, is the HTTP/1.1 exchange starting connections.
+	// Connections without the expected request go to Fallback.
+	Camouflage *transport.Camouflage
 }
 
+// ErrServerClosed is returned by Start after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
 type Server struct {
-	option *ServerOption
-	crt    tls.Certificate
-	secret string
+	option     *ServerOption
+	certs      *certificates
+	keys       auth.Keys
+	users      *auth.Users
+	nonces     *pipe.NonceCache
+	resumes    *pipe.ResumeTable
+	clientAuth *clientAuth
+	drain      *drain
+	transport  transport.Transport
+	mu         sync.Mutex
+	listener   net.Listener
 }
 
 func NewServer(o *ServerOption) (*Server, error) {
 	s := &Server{
-		option: o,
-		secret: o.Secret,
+		option:  o,
+		keys:    auth.Secret(o.Secret),
+		nonces:  pipe.NewNonceCache(pipe.DefaultNonceCacheSize),
+		resumes: pipe.NewResumeTable(),
+		drain:   newDrain(),
+	}
+	certs, err := loadCertificates(o.CrtPath, o.KeyPath, o.Certificates)
+	if err != nil {
+		return nil, fmt.Errorf("error creating server, %v", err)
+	}
+	s.certs = certs
+
+	if o.UsersPath != "" {
+		users, err := auth.LoadUsers(o.UsersPath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating server, %v", err)
+		}
+		log.Infof("loaded %d users from %s", users.Len(), o.UsersPath)
+		s.users = users
+		s.keys = users
+	}
+
+	if o.ClientCAPath != "" {
+		a, err := loadClientAuth(o.ClientCAPath, o.CRLPath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating server, %v", err)
+		}
+		s.clientAuth = a
 	}
-	cert, err := tls.LoadX509KeyPair(o.CrtPath, o.KeyPath)
+
+	// client certificates are the only credential with mutual TLS
+	if o.ClientCAPath != "" && o.Transport != "" && o.Transport != transport.TLS {
+		return nil, fmt.Errorf("error creating server, client CA requires the %s transport", transport.TLS)
+	}
+	s.transport, err = transport.New(o.Transport, &transport.Config{
+		TLS:      s.tlsConfig(),
+		Path:     o.Path,
+		Fallback: s.fallbackHandler(),
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error creating server, %v", err)
 	}
-	s.crt = cert
 	return s, nil
 }
 
+// Reload reloads the certificate, the users file and the CRL, pipes already
+// authenticated are kept.
+func (s *Server) Reload() error {
+	if err := s.certs.reload(); err != nil {
+		return err
+	}
+	if s.users != nil {
+		if err := s.users.Reload(); err != nil {
+			return err
+		}
+		log.Infof("reloaded %d users from %s", s.users.Len(), s.option.UsersPath)
+	}
+	if s.clientAuth != nil && s.option.CRLPath != "" {
+		if err := s.clientAuth.reloadCRL(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) allow(user string, addr socks.Addr) bool {
+	return s.option.Allow == nil || s.option.Allow(user, addr)
+}
+
 func (s *Server) Start() error {
 	log.Infof("Listening at %s\n", s.option.Listen)
-	l, err := tls.Listen("tcp", s.option.Listen, &tls.Config{Certificates: []tls.Certificate{s.crt}})
+	l, err := s.transport.Listen(s.option.Listen)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.certs.watch(stop)
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.drain.isDraining() {
+				return ErrServerClosed
+			}
 			log.Error(err)
 			continue
 		}
@@ -54,13 +169,85 @@ func (s *Server) Start() error {
 	}
 }
 
+// Shutdown stops accepting connections and tells clients to go away with
+// a CmdGoAway on every pipe and session. Active connections are given the
+// grace period to finish before everything is closed.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	l := s.listener
+	s.mu.Unlock()
+	grace := s.option.GracePeriod
+	if grace == 0 {
+		grace = DefaultGracePeriod
+	}
+	// Start returns once the listener is closed while draining
+	s.drain.goAway()
+	if l != nil {
+		l.Close()
+	}
+	s.drain.wait(grace)
+}
+
 func (s *Server) handleConn(conn net.Conn) {
-	defer conn.Close()
-	p := pipe.New(conn, time.Duration(0))
-	defer p.Close()
+	if c, ok := conn.(interface{ Handshake() error }); ok && s.clientAuth != nil {
+		// the client certificate is checked before the first pipe handshake
+		if err := c.Handshake(); err != nil {
+			log.Errorf("[%s] tls handshake error, %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	rc := newRecordConn(conn)
+	var pc net.Conn = rc
+	if s.option.Camouflage != nil {
+		c, err := s.option.Camouflage.Server(rc)
+		if err != nil {
+			log.Errorf("[%s] camouflage error, %v", conn.RemoteAddr(), err)
+			if s.option.Fallback != "" && rc.replayable() && errors.Is(err, transport.ErrCamouflage) {
+				log.Infof("[%s] fallback to %s", conn.RemoteAddr(), s.option.Fallback)
+				s.fallback(rc)
+			}
+			conn.Close()
+			return
+		}
+		pc = c
+	}
+	p := pipe.New(pc, time.Duration(0))
+	p.SetFeatures(pipe.Features{MaxFrame: s.option.MaxFrameSize})
+	resumed := false
+	defer func() {
+		// a resumed pipe owns the connection
+		if !resumed {
+			p.Close()
+			conn.Close()
+		}
+	}()
+	untrack, ok := s.drain.addPipe(p)
+	defer untrack()
+	if !ok {
+		return
+	}
 	for {
 		// Noted that tcp keep alive message will return timeout when deadline is set.
-		addr, err := p.WaitForHandShake(s.secret)
+		addr, user, err := p.WaitForHandShake(s.handShakeKeys(conn), s.nonces)
+
+		if err == pipe.ErrUpgrade {
+			rc.stop()
+			// a CmdGoAway of p would not be multiplexed
+			untrack()
+			s.serveSession(conn, p, identity(conn, user))
+			return
+		}
+
+		if err == pipe.ErrResume {
+			rc.stop()
+			if err := s.resumes.Resume(p); err != nil {
+				log.Warnf("[%s] [user: %s] resume error, %v", p, user, err)
+				return
+			}
+			resumed = true
+			return
+		}
 
 		if err == io.EOF {
 			log.Errorf("[%s] pipe closed", p)
@@ -69,21 +256,125 @@ func (s *Server) handleConn(conn net.Conn) {
 
 		if err != nil {
 			log.Errorf("[%s] handshake error, %v", p, err)
+			if s.option.Fallback != "" && rc.replayable() && pipe.IsAuthError(err) {
+				log.Infof("[%s] fallback to %s", p, s.option.Fallback)
+				s.fallback(rc)
+			}
 			return
 		}
+		rc.stop()
 
-		log.Infof("[%s] new connection %s", addr)
-		tgt, err := net.Dial("tcp", addr.String())
+		user = identity(conn, user)
+		if !s.drain.begin() {
+			log.Infof("[%s] [user: %s] connection %s refused, server going away", p, user, addr)
+			// the CmdGoAway sent by Shutdown may not be written yet, the
+			// client must know the refusal is not worth retrying on p
+			if err = p.GoAway(); err == nil {
+				err = p.Reject(socks.ErrGeneralFailure)
+			}
+		} else {
+			err = s.connect(p, user, addr)
+			s.drain.done()
+		}
 		if err != nil {
-			log.Errorf("[%s] connection %s failed, %s", p, addr, err)
+			log.Debugf("%s pipe close, %s", p, err)
 			return
 		}
+	}
+}
+
+// connect serves a connection to addr requested on p, an error is returned
+// if p can not be used anymore.
+func (s *Server) connect(p *pipe.Pipe, user string, addr socks.Addr) error {
+	log.Infof("[%s] [user: %s] new connection %s", p, user, addr)
+	if !s.allow(user, addr) {
+		log.Warnf("[%s] [user: %s] connection %s not allowed", p, user, addr)
+		return p.Reject(socks.ErrConnectionNotAllowed)
+	}
 
-		err = p.Bind(tgt)
-		log.Infof("[%s] connection %s closed", p, addr)
+	tgt, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		log.Errorf("[%s] connection %s failed, %s", p, addr, err)
+		return p.Reject(socks.DialError(err))
+	}
+
+	if err := p.Confirm(); err != nil {
+		tgt.Close()
+		return err
+	}
+
+	remove := s.resumes.Add(p)
+	err = p.Bind(tgt)
+	remove()
+	log.Infof("[%s] connection %s closed", p, addr)
+	return err
+}
+
+func (s *Server) serveSession(conn net.Conn, p *pipe.Pipe, user string) {
+	if err := p.Confirm(); err != nil {
+		log.Errorf("[%s] session error, %v", p, err)
+		p.Close()
+		return
+	}
+	sess, err := pipe.NewServerSession(p, s.option.Window)
+	if err != nil {
+		log.Errorf("[%s] session error, %v", p, err)
+		return
+	}
+	defer sess.Close()
+	defer s.drain.addSession(sess)()
+	log.Debugf("[%s] [user: %s] session started", sess, user)
+	for {
+		st, err := sess.Accept()
 		if err != nil {
-			log.Debugf("%s pipe close, %s", p, err)
+			log.Debugf("[%s] session closed, %v", sess, err)
 			return
 		}
+		go s.handleStream(conn, sess, st)
+	}
+}
+
+func (s *Server) handleStream(conn net.Conn, sess *pipe.Session, st *pipe.Stream) {
+	defer st.Close()
+	addr, user, err := st.WaitForHandShake(s.handShakeKeys(conn), s.nonces)
+	if err != nil {
+		log.Errorf("[%s] handshake error, %v", st, err)
+		sess.Close()
+		return
+	}
+
+	user = identity(conn, user)
+	if !s.drain.begin() {
+		log.Infof("[%s] [user: %s] connection %s refused, server going away", st, user, addr)
+		// sent before the refusal, as for pipes
+		if sess.GoAway() == nil {
+			st.Reject(socks.ErrGeneralFailure)
+		}
+		return
+	}
+	defer s.drain.done()
+	log.Infof("[%s] [user: %s] new connection %s", st, user, addr)
+	if !s.allow(user, addr) {
+		log.Warnf("[%s] [user: %s] connection %s not allowed", st, user, addr)
+		st.Reject(socks.ErrConnectionNotAllowed)
+		return
+	}
+
+	tgt, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		log.Errorf("[%s] connection %s failed, %s", st, addr, err)
+		st.Reject(socks.DialError(err))
+		return
+	}
+
+	if err := st.Confirm(); err != nil {
+		tgt.Close()
+		return
+	}
+
+	err = st.Bind(tgt)
+	log.Infof("[%s] connection %s closed", st, addr)
+	if err != nil {
+		log.Debugf("%s stream close, %s", st, err)
 	}
 }
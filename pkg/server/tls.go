@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iberryful/sproxy/pkg/auth"
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// clientAuth verifies client certificates against a CA bundle and rejects
+// the ones revoked by a local CRL file.
+type clientAuth struct {
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	crlPath string
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+}
+
+func loadClientAuth(caPath, crlPath string) (*clientAuth, error) {
+	b, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client CA, %v", err)
+	}
+	a := &clientAuth{
+		roots:   x509.NewCertPool(),
+		crlPath: crlPath,
+	}
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client CA, %v", err)
+		}
+		a.roots.AddCert(cert)
+		a.cas = append(a.cas, cert)
+	}
+	if len(a.cas) == 0 {
+		return nil, fmt.Errorf("error loading client CA, no certificate found in %s", caPath)
+	}
+
+	if crlPath != "" {
+		if err := a.reloadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// reloadCRL reads the CRL file again, the CRL must be signed by one of the
+// client CAs.
+func (a *clientAuth) reloadCRL() error {
+	b, err := ioutil.ReadFile(a.crlPath)
+	if err != nil {
+		return fmt.Errorf("error loading CRL, %v", err)
+	}
+	// PEM or DER, as ParseCRL accepted
+	if block, _ := pem.Decode(b); block != nil && block.Type == "X509 CRL" {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return fmt.Errorf("error loading CRL, %v", err)
+	}
+
+	signed := false
+	for _, ca := range a.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("error loading CRL, %s is not signed by the client CA", a.crlPath)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		log.Warnf("CRL %s has expired, next update: %s", a.crlPath, crl.NextUpdate)
+	}
+
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+	for _, c := range crl.RevokedCertificateEntries {
+		revoked[c.SerialNumber.String()] = struct{}{}
+	}
+	a.mu.Lock()
+	a.revoked = revoked
+	a.mu.Unlock()
+	log.Infof("loaded %d revoked certificates from %s", len(revoked), a.crlPath)
+	return nil
+}
+
+// configure makes conf require a client certificate verified by a.
+// Revocation is checked in VerifyConnection, which crypto/tls also calls
+// on resumed sessions, unlike VerifyPeerCertificate: a client revoked since
+// would resume with a ticket of its certificate.
+func (a *clientAuth) configure(conf *tls.Config) {
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	conf.ClientCAs = a.roots
+	conf.VerifyConnection = a.verify
+}
+
+// verify checks the verified chains of cs against the CRL.
+func (a *clientAuth) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if _, ok := a.revoked[cert.SerialNumber.String()]; ok {
+				return fmt.Errorf("client certificate %s is revoked", cert.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	conf := &tls.Config{GetCertificate: s.certs.get}
+	if s.clientAuth != nil {
+		s.clientAuth.configure(conf)
+	}
+	return conf
+}
+
+// clientCert returns the verified client certificate of conn, or nil if
+// there is none.
+func clientCert(conn net.Conn) *x509.Certificate {
+	c, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return nil
+	}
+	chains := c.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
+
+// identity returns the subject of the verified client certificate of conn,
+// or user if there is none.
+func identity(conn net.Conn, user string) string {
+	if cert := clientCert(conn); cert != nil {
+		return cert.Subject.String()
+	}
+	return user
+}
+
+// handShakeKeys returns the keys handshakes on conn are checked with, none
+// if the client has a verified certificate, which is its credential.
+func (s *Server) handShakeKeys(conn net.Conn) auth.Keys {
+	if clientCert(conn) != nil {
+		return nil
+	}
+	return s.keys
+}
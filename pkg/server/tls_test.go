@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates and CRLs for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate with serial signed by ca, for a client or
+// for the server of localhost.
+func (ca *testCA) issue(t *testing.T, serial int64, client bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.Subject.CommonName = "alice"
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCRL writes a PEM CRL of ca revoking serials to path.
+func (ca *testCA) writeCRL(t *testing.T, path string, number int64, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client with conf to a server with sconf, it returns
+// the state of the client and the error of the server.
+func handshake(t *testing.T, sconf, conf *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		err = conn.(*tls.Conn).Handshake()
+		if err == nil {
+			// the client reads the session tickets along with it
+			_, err = conn.Write([]byte{1})
+		}
+		errc <- err
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Read(make([]byte, 1))
+	state := conn.ConnectionState()
+	err = <-errc
+	io.Copy(ioutil.Discard, conn)
+	return state, err
+}
+
+func TestRevokedClientResumption(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caPath, crlPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ca.writeCRL(t, crlPath, 1)
+	a, err := loadClientAuth(caPath, crlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sconf := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, 2, false)}}
+	a.configure(sconf)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conf := &tls.Config{
+		RootCAs:            roots,
+		ServerName:         "localhost",
+		Certificates:       []tls.Certificate{ca.issue(t, 3, true)},
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+
+	if _, err := handshake(t, sconf, conf); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := handshake(t, sconf, conf); err != nil || !state.DidResume {
+		t.Fatalf("session not resumed, %v", err)
+	}
+
+	ca.writeCRL(t, crlPath, 2, 3)
+	if err := a.reloadCRL(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, sconf, conf); err == nil {
+		t.Fatal("revoked client certificate accepted through a resumed session")
+	}
+}
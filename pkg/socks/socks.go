@@ -3,9 +3,11 @@
 package socks
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"syscall"
 )
 
 // UDPEnabled is the toggle for UDP support
@@ -51,9 +53,13 @@ const MaxAddrLen = 1 + 1 + 255 + 2
 // Addr represents a SOCKS address as defined in RFC 1928 section 5.
 type Addr []byte
 
-// String serializes SOCKS address a to string form.
+// String serializes SOCKS address a to string form, malformed addresses
+// give an empty string.
 func (a Addr) String() string {
 	var host, port string
+	if len(a) == 0 || len(SplitAddr(a)) != len(a) {
+		return ""
+	}
 
 	switch a[0] { // address type
 	case AtypDomainName:
@@ -171,6 +177,51 @@ func ParseAddr(s string) Addr {
 
 // Handshake fast-tracks SOCKS initialization to get target address to connect.
 func Handshake(rw io.ReadWriter) (Addr, error) {
+	addr, err := ReadRequest(rw)
+	if err != nil {
+		return addr, err
+	}
+	return addr, Reply(rw, nil)
+}
+
+// Reply writes the reply to a CONNECT request, a nil err means succeeded.
+// Errors other than Error are reported as ErrGeneralFailure.
+func Reply(w io.Writer, err error) error {
+	rep := byte(0)
+	if err != nil {
+		rep = byte(ErrGeneralFailure)
+		if e, ok := err.(Error); ok {
+			rep = byte(e)
+		}
+	}
+	_, err = w.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5
+	return err
+}
+
+// DialError maps the error of dialing a target to a SOCKS error.
+func DialError(err error) Error {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrHostUnreachable
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrHostUnreachable
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrTTLExpired
+	}
+	return ErrGeneralFailure
+}
+
+// ReadRequest is like Handshake, but the reply to a CONNECT request is left
+// to the caller, see Reply.
+func ReadRequest(rw io.ReadWriter) (Addr, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
 	// read VER, NMETHODS, METHODS
@@ -196,7 +247,6 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 	}
 	switch cmd {
 	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
 	case CmdUDPAssociate:
 		if !UDPEnabled {
 			return nil, ErrCommandNotSupported
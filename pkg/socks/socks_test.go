@@ -0,0 +1,88 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// seedAddrs are valid addresses of every type for the fuzz corpus.
+var seedAddrs = []Addr{
+	ParseAddr("127.0.0.1:1080"),
+	ParseAddr("[::1]:443"),
+	ParseAddr("example.com:80"),
+	{AtypDomainName, 0, 0, 80},
+}
+
+func FuzzSocksSplitAddr(f *testing.F) {
+	for _, a := range seedAddrs {
+		f.Add(append(append([]byte{}, a...), 1, 2, 3))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		a := SplitAddr(b)
+		if a == nil {
+			return
+		}
+		if !bytes.Equal(a, b[:len(a)]) {
+			t.Fatalf("%x is not a prefix of %x", a, b)
+		}
+		if a.String() == "" {
+			t.Fatalf("split address %x not printable", a)
+		}
+	})
+}
+
+// FuzzSocksAddrString prints arbitrary addresses. IP addresses printed must
+// parse back to an address printed the same, domain names are any bytes
+// and only parsed.
+func FuzzSocksAddrString(f *testing.F) {
+	for _, a := range seedAddrs {
+		f.Add([]byte(a))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s := Addr(b).String()
+		if s == "" {
+			if len(b) > 0 && len(SplitAddr(b)) == len(b) {
+				t.Fatalf("valid address %x not printed", b)
+			}
+			return
+		}
+		a := ParseAddr(s)
+		if b[0] == AtypDomainName {
+			return
+		}
+		if a == nil {
+			t.Fatalf("address %q not parsed", s)
+		}
+		if a.String() != s {
+			t.Fatalf("address %q printed back as %q", s, a.String())
+		}
+	})
+}
+
+// clientConn plays the client side of a SOCKS connection, it reads from r
+// and discards the replies.
+type clientConn struct {
+	io.Reader
+	replies bytes.Buffer
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+func FuzzSocksReadRequest(f *testing.F) {
+	for _, a := range seedAddrs {
+		f.Add(append([]byte{5, 1, 0, 5, CmdConnect, 0}, a...))
+	}
+	f.Add([]byte{5, 1, 0, 5, CmdUDPAssociate, 0, AtypIPv4, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		addr, err := ReadRequest(&clientConn{Reader: bytes.NewReader(b)})
+		if err != nil {
+			return
+		}
+		if len(SplitAddr(addr)) != len(addr) || addr.String() == "" {
+			t.Fatalf("malformed address %x read", addr)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrCamouflage is returned by Camouflage.Server when the request does not
+// match, the connection is then left to the fallback.
+var ErrCamouflage = errors.New("unexpected camouflage request")
+
+// camouflageTimeout bounds the request and response exchange.
+const camouflageTimeout = 10 * time.Second
+
+// defaultCamouflageHeader is sent when Camouflage.Header is empty.
+var defaultCamouflageHeader = http.Header{
+	"User-Agent":      {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.116 Safari/537.36"},
+	"Accept":          {"*/*"},
+	"Accept-Language": {"en-US,en;q=0.9"},
+}
+
+// Camouflage starts connections with an HTTP/1.1 request and response
+// exchange before the frames of the pipe, so that they look like a
+// download. The server only checks the path and Host of the request.
+type Camouflage struct {
+	// Path is the request path, "/" by default.
+	Path string
+	// Host is the Host header, the dialed address by default on the
+	// client, any host is accepted by the server if empty.
+	Host string
+	// Header is sent with the request, browser like headers by default.
+	Header http.Header
+}
+
+func (c *Camouflage) path() string {
+	if c.Path == "" {
+		return DefaultPath
+	}
+	return c.Path
+}
+
+// Client sends the request on conn, to addr, and reads the response.
+func (c *Camouflage) Client(conn net.Conn, addr string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+c.path(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Host != "" {
+		req.Host = c.Host
+	}
+	req.Header = c.Header
+	if len(req.Header) == 0 {
+		req.Header = defaultCamouflageHeader
+	}
+
+	conn.SetDeadline(time.Now().Add(camouflageTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("camouflage response error, %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("camouflage refused, %s", resp.Status)
+	}
+	return withBuffered(conn, br), nil
+}
+
+// Server reads the request on conn and answers it, ErrCamouflage is
+// returned if its method, path or Host do not match.
+func (c *Camouflage) Server(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(camouflageTimeout))
+	defer conn.SetDeadline(time.Time{})
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrCamouflage, err)
+	}
+	if req.Method != http.MethodGet || req.URL.Path != c.path() ||
+		(c.Host != "" && !strings.EqualFold(req.Host, c.Host)) {
+		return nil, fmt.Errorf("%w, %s %s, host: %s", ErrCamouflage, req.Method, req.URL.Path, req.Host)
+	}
+
+	// a download whose length is unknown, it ends with the connection
+	resp := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		return nil, err
+	}
+	return withBuffered(conn, br), nil
+}
+
+// withBuffered returns conn reading first what br buffered past the
+// exchange, if anything.
+func withBuffered(conn net.Conn, br *bufio.Reader) net.Conn {
+	n := br.Buffered()
+	if n == 0 {
+		return conn
+	}
+	b, _ := br.Peek(n)
+	return &prefixConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), conn),
+	}
+}
+
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ConnectionState exposes the TLS state of Conn for channel binding.
+func (c *prefixConn) ConnectionState() tls.ConnectionState {
+	if tc, ok := c.Conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return tc.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	_ "unsafe" // for go:linkname
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2 is the name of the HTTP/2 transport.
+const HTTP2 = "h2"
+
+// connectProtocol is the :protocol of the extended CONNECT opening a
+// stream.
+const connectProtocol = "sproxy"
+
+// disableExtendedConnect is the switch of extended CONNECT in the servers of
+// x/net/http2, which only clear it when GODEBUG holds http2xconnect=1 at
+// their init and have no option for it. The init of this package runs after
+// theirs and clears it instead, the GODEBUG setting is not accepted by
+// //go:debug either.
+//
+//go:linkname disableExtendedConnect golang.org/x/net/http2.disableExtendedConnectProtocol
+var disableExtendedConnect bool
+
+func init() {
+	disableExtendedConnect = false
+	Register(HTTP2, newHTTP2)
+}
+
+// h2Transport runs each pipe in an HTTP/2 stream, the streams of a client
+// share one TLS connection. Streams are opened by an extended CONNECT (RFC
+// 8441) to Path with connectProtocol as :protocol, the DATA frames of both
+// ways carry the frames of the pipe. Other requests are served by the
+// fallback handler. Handshakes are bound to the TLS connection of the
+// stream. x/net is kept before v0.54, whose clients defer to net/http from
+// Go 1.27 on, and net/http refuses the :protocol header.
+type h2Transport struct {
+	conf     *tls.Config
+	client   *http2.Transport
+	path     string
+	host     string
+	fallback http.Handler
+}
+
+func newHTTP2(c *Config) (Transport, error) {
+	if c == nil || c.TLS == nil {
+		return nil, fmt.Errorf("transport %s requires a TLS config", HTTP2)
+	}
+	t := &h2Transport{
+		conf:     c.TLS,
+		client:   &http2.Transport{TLSClientConfig: c.TLS},
+		path:     c.Path,
+		host:     c.Host,
+		fallback: c.Fallback,
+	}
+	if t.path == "" {
+		t.path = DefaultPath
+	}
+	if !strings.HasPrefix(t.path, "/") {
+		return nil, fmt.Errorf("invalid path %q, it must start with /", t.path)
+	}
+	if t.fallback == nil {
+		t.fallback = http.NotFoundHandler()
+	}
+	return t, nil
+}
+
+func (t *h2Transport) Dial(addr string) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, "https://"+addr+t.path, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(":protocol", connectProtocol)
+	if t.host != "" {
+		req.Host = t.host
+	}
+	var reused bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}))
+	resp, err := t.client.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("stream to %s refused, %s", req.URL, resp.Status)
+	}
+
+	conn, inner := memPipe(h2Addr("client"), h2Addr(addr))
+	go func() {
+		bridge(inner, resp.Body, pw)
+		pw.Close()
+	}()
+	return &h2Conn{Conn: conn, state: resp.TLS, reused: reused}, nil
+}
+
+func (t *h2Transport) Listen(addr string) (net.Listener, error) {
+	conf := t.conf.Clone()
+	// HTTP/1.1 is kept for the fallback
+	conf.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	l, err := tls.Listen("tcp", addr, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	hl := newHTTPListener(l)
+	if err := http2.ConfigureServer(hl.srv, &http2.Server{}); err != nil {
+		l.Close()
+		return nil, err
+	}
+	hl.serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != t.path || r.Method != http.MethodConnect || r.Header.Get(":protocol") != connectProtocol {
+			t.fallback.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		conn, inner := memPipe(hl.Addr(), h2Addr(r.RemoteAddr))
+		if hl.push(&h2Conn{Conn: conn, state: r.TLS}) {
+			// the stream ends when the handler returns
+			bridge(inner, r.Body, flushWriter{w})
+		}
+	}))
+	return hl, nil
+}
+
+// bridge copies between conn, the inner end of the connection of a pipe,
+// and the bodies of its stream until either side ends.
+func bridge(conn net.Conn, r io.ReadCloser, w io.Writer) {
+	go func() {
+		io.Copy(conn, r)
+		conn.Close()
+	}()
+	io.Copy(w, conn)
+	conn.Close()
+	r.Close()
+}
+
+// h2Conn is the connection of a pipe in a stream, it exposes the state of
+// the TLS connection carrying the stream.
+type h2Conn struct {
+	net.Conn
+	state  *tls.ConnectionState
+	reused bool
+}
+
+// Reused reports whether the stream was opened on a TLS connection dialed
+// for another one.
+func (c *h2Conn) Reused() bool {
+	return c.reused
+}
+
+// ConnectionState exposes the TLS state of the connection for channel
+// binding.
+func (c *h2Conn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
+
+// flushWriter sends every write as it is made.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (w flushWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.w.(http.Flusher).Flush()
+	return n, err
+}
+
+type h2Addr string
+
+func (a h2Addr) Network() string {
+	return HTTP2
+}
+
+func (a h2Addr) String() string {
+	return string(a)
+}
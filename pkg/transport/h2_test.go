@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHTTP2ConnectionState(t *testing.T) {
+	client, server := dialPair(t, HTTP2)
+	if !bytes.Equal(exportedKey(t, client), exportedKey(t, server)) {
+		t.Fatal("ends of an h2 stream export different keys")
+	}
+}
+
+func TestHTTP2Reused(t *testing.T) {
+	sconf, cconf := testTLSConfigs(t)
+	st, _ := New(HTTP2, &Config{TLS: sconf})
+	ct, _ := New(HTTP2, &Config{TLS: cconf})
+	l, err := st.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := ct.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if reused := conn.(interface{ Reused() bool }).Reused(); reused != (i > 0) {
+			t.Fatalf("stream %d reused: %v", i, reused)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/iberryful/sproxy/pkg/log"
+)
+
+// httpListener accepts the connections its HTTP server hands over with
+// push, the requests of HTTP based transports.
+type httpListener struct {
+	net.Listener
+	srv       *http.Server
+	ch        chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHTTPListener(l net.Listener) *httpListener {
+	return &httpListener{
+		Listener: l,
+		srv:      &http.Server{},
+		ch:       make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// serve serves h until the listener is closed.
+func (l *httpListener) serve(h http.Handler) {
+	l.srv.Handler = h
+	go func() {
+		err := l.srv.Serve(l.Listener)
+		if err != http.ErrServerClosed {
+			log.Errorf("http listener %s closed, %v", l.Addr(), err)
+		}
+		l.Close()
+	}()
+}
+
+// push hands conn to Accept, it returns false if the listener is closed.
+func (l *httpListener) push(conn net.Conn) bool {
+	select {
+	case l.ch <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: ErrListenerClosed}
+	}
+}
+
+// Close stops accepting connections, those already accepted are left open.
+func (l *httpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.srv.Close()
+	})
+	return nil
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// loopbackListeners are the listeners of the loopback transport by
+// address, shared by every client and server of the process.
+var loopbackListeners = struct {
+	sync.Mutex
+	m map[string]*loopbackListener
+}{m: make(map[string]*loopbackListener)}
+
+// loopbackTransport connects clients and servers of the same process
+// in memory, for tests. Addresses are arbitrary names.
+type loopbackTransport struct{}
+
+func newLoopback(*Config) (Transport, error) {
+	return loopbackTransport{}, nil
+}
+
+func (loopbackTransport) Dial(addr string) (net.Conn, error) {
+	loopbackListeners.Lock()
+	l := loopbackListeners.m[addr]
+	loopbackListeners.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: Loopback, Addr: loopbackAddr(addr), Err: errors.New("connection refused")}
+	}
+	client, server := memPipe(loopbackAddr("client"), loopbackAddr(addr))
+	select {
+	case l.ch <- server:
+		return client, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: Loopback, Addr: loopbackAddr(addr), Err: ErrListenerClosed}
+	}
+}
+
+func (loopbackTransport) Listen(addr string) (net.Listener, error) {
+	loopbackListeners.Lock()
+	defer loopbackListeners.Unlock()
+	if _, ok := loopbackListeners.m[addr]; ok {
+		return nil, fmt.Errorf("loopback address %q already in use", addr)
+	}
+	l := &loopbackListener{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+	loopbackListeners.m[addr] = l
+	return l, nil
+}
+
+type loopbackListener struct {
+	addr      string
+	ch        chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *loopbackListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: Loopback, Addr: l.Addr(), Err: ErrListenerClosed}
+	}
+}
+
+func (l *loopbackListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		loopbackListeners.Lock()
+		delete(loopbackListeners.m, l.addr)
+		loopbackListeners.Unlock()
+	})
+	return nil
+}
+
+func (l *loopbackListener) Addr() net.Addr {
+	return loopbackAddr(l.addr)
+}
+
+type loopbackAddr string
+
+func (a loopbackAddr) Network() string {
+	return Loopback
+}
+
+func (a loopbackAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLoopback(t *testing.T) {
+	tr, err := New(Loopback, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tr.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := tr.Listen("server"); err == nil {
+		t.Fatal("address listened on twice")
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	conn, err := tr.Dial("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "server" || conn.RemoteAddr().Network() != Loopback {
+		t.Fatalf("unexpected remote address %s/%s", conn.RemoteAddr().Network(), conn.RemoteAddr())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestLoopbackClosed(t *testing.T) {
+	tr, _ := New(Loopback, &Config{})
+	if _, err := tr.Dial("nowhere"); err == nil {
+		t.Fatal("dialed an address nobody listens on")
+	}
+
+	l, err := tr.Listen("closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a dial waiting for Accept, or too late to find the listener, fails
+	// once it is closed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.Dial("closed")
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("dial not failed by Close")
+	}
+	if _, err := l.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("accepted on a closed listener, %v", err)
+	}
+
+	// the address is free again
+	l, err = tr.Listen("closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// memBufSize bounds the bytes buffered in each direction of a memConn,
+// writers block once it is full as they would on a socket.
+const memBufSize = 256 * 1024
+
+// timeoutError is returned by memConn when a deadline expires.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// memBuf is one direction of a memConn.
+type memBuf struct {
+	wmu      sync.Mutex // serializes writes, each is written in one piece
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	eof      bool // the writer is closed
+	closed   bool // the reader is closed
+	rTimer   *time.Timer
+	wTimer   *time.Timer
+	rExpired bool
+	wExpired bool
+}
+
+func newMemBuf() *memBuf {
+	b := &memBuf{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memBuf) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.eof && !b.closed && !b.rExpired {
+		b.cond.Wait()
+	}
+	switch {
+	case b.closed:
+		return 0, net.ErrClosed
+	case b.rExpired:
+		return 0, timeoutError{}
+	case b.buf.Len() == 0:
+		return 0, io.EOF
+	}
+	n, _ := b.buf.Read(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *memBuf) write(p []byte) (n int, err error) {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(p) > 0 {
+		for b.buf.Len() >= memBufSize && !b.eof && !b.closed && !b.wExpired {
+			b.cond.Wait()
+		}
+		switch {
+		case b.eof:
+			return n, net.ErrClosed
+		case b.closed:
+			return n, io.ErrClosedPipe
+		case b.wExpired:
+			return n, timeoutError{}
+		}
+		m := min(len(p), memBufSize-b.buf.Len())
+		b.buf.Write(p[:m])
+		b.cond.Broadcast()
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// close closes the reader side if reader, the writer side otherwise.
+func (b *memBuf) close(reader bool) {
+	b.mu.Lock()
+	if reader {
+		b.closed = true
+	} else {
+		b.eof = true
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// setDeadline sets the read or write deadline, the zero time clears it.
+func (b *memBuf) setDeadline(t time.Time, read bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	timer, expired := &b.wTimer, &b.wExpired
+	if read {
+		timer, expired = &b.rTimer, &b.rExpired
+	}
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	*expired = false
+	if t.IsZero() {
+		return
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		*expired = true
+		b.cond.Broadcast()
+		return
+	}
+	*timer = time.AfterFunc(d, func() {
+		b.mu.Lock()
+		*expired = true
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+}
+
+// memConn is an in-memory connection, buffered in both directions.
+type memConn struct {
+	r, w      *memBuf
+	local     net.Addr
+	remote    net.Addr
+	closeOnce sync.Once
+}
+
+// memPipe returns both ends of an in-memory connection from local to
+// remote.
+func memPipe(local, remote net.Addr) (client net.Conn, server net.Conn) {
+	c2s, s2c := newMemBuf(), newMemBuf()
+	return &memConn{r: s2c, w: c2s, local: local, remote: remote},
+		&memConn{r: c2s, w: s2c, local: remote, remote: local}
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	return c.r.read(p)
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	return c.w.write(p)
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.r.close(true)
+		c.w.close(false)
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.r.setDeadline(t, true)
+	c.w.setDeadline(t, false)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(t, true)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.w.setDeadline(t, false)
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
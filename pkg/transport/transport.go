@@ -0,0 +1,121 @@
+// Package transport carries the connections of pipes between clients and
+// servers. A transport is selected by name, new ones are added by Register.
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Names of the transports shipped with sproxy.
+const (
+	TLS      = "tls"
+	TCP      = "tcp"
+	Loopback = "loopback"
+)
+
+// Transport dials and listens for the connections pipes run over.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// Config is what a transport is created with. TLS is the client config on
+// the client side and the server config on the server side, transports not
+// encrypting their connections ignore it. Path and Host are the request
+// path and Host header of HTTP based transports, the Host header defaults
+// to the dialed address. Fallback serves the other requests such
+// transports receive, nil replies 404.
+type Config struct {
+	TLS      *tls.Config
+	Path     string
+	Host     string
+	Fallback http.Handler
+}
+
+// Factory creates a transport from the config of a client or a server.
+type Factory func(c *Config) (Transport, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{
+		TLS:      newTLS,
+		TCP:      newTCP,
+		Loopback: newLoopback,
+	}
+)
+
+// Register makes a transport available by name, replacing any transport
+// registered before with that name.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = f
+}
+
+// New creates the transport registered as name, "" means TLS.
+func New(name string, c *Config) (Transport, error) {
+	if name == "" {
+		name = TLS
+	}
+	mu.RLock()
+	f, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q, available: %v", name, Names())
+	}
+	return f(c)
+}
+
+// Names returns the names of the registered transports.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsTransport runs pipes over TLS on TCP, the channel binding of pipes
+// relies on it.
+type tlsTransport struct {
+	conf *tls.Config
+}
+
+func newTLS(c *Config) (Transport, error) {
+	if c == nil || c.TLS == nil {
+		return nil, fmt.Errorf("transport %s requires a TLS config", TLS)
+	}
+	return tlsTransport{conf: c.TLS}, nil
+}
+
+func (t tlsTransport) Dial(addr string) (net.Conn, error) {
+	return tls.Dial("tcp", addr, t.conf)
+}
+
+func (t tlsTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.conf)
+}
+
+// tcpTransport runs pipes over plain TCP, for networks already encrypted
+// or for debugging. Handshakes are not bound to a channel.
+type tcpTransport struct{}
+
+func newTCP(*Config) (Transport, error) {
+	return tcpTransport{}, nil
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
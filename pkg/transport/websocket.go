@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Names of the WebSocket transports, over plain HTTP, as behind a reverse
+// proxy or CDN terminating TLS, and over TLS.
+const (
+	WebSocket       = "ws"
+	WebSocketSecure = "wss"
+)
+
+// DefaultPath is the request path of HTTP based transports when
+// Config.Path is not set.
+const DefaultPath = "/"
+
+func init() {
+	Register(WebSocket, newWebSocket(false))
+	Register(WebSocketSecure, newWebSocket(true))
+}
+
+// wsTransport runs pipes in binary WebSocket messages. The client upgrades
+// a request for Path with Host as Host header, the server serves other
+// requests with the fallback handler. Over wss handshakes are bound to the
+// TLS connection carrying the messages, so TLS terminated by a proxy fails
+// them, such proxies are to be reached with ws.
+type wsTransport struct {
+	conf     *tls.Config
+	secure   bool
+	path     string
+	host     string
+	fallback http.Handler
+}
+
+func newWebSocket(secure bool) Factory {
+	return func(c *Config) (Transport, error) {
+		if c == nil {
+			c = &Config{}
+		}
+		if secure && c.TLS == nil {
+			return nil, fmt.Errorf("transport %s requires a TLS config", WebSocketSecure)
+		}
+		t := &wsTransport{
+			conf:     c.TLS,
+			secure:   secure,
+			path:     c.Path,
+			host:     c.Host,
+			fallback: c.Fallback,
+		}
+		if t.path == "" {
+			t.path = DefaultPath
+		}
+		if !strings.HasPrefix(t.path, "/") {
+			return nil, fmt.Errorf("invalid path %q, it must start with /", t.path)
+		}
+		if t.fallback == nil {
+			t.fallback = http.NotFoundHandler()
+		}
+		return t, nil
+	}
+}
+
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	host := t.host
+	if host == "" {
+		host = addr
+	}
+	scheme, origin := "ws", "http"
+	if t.secure {
+		scheme, origin = "wss", "https"
+	}
+	conf, err := websocket.NewConfig(scheme+"://"+host+t.path, origin+"://"+host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if t.secure {
+		conn, err = tls.Dial("tcp", addr, t.conf)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(conf, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade of %s failed, %v", conf.Location, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, closed: make(chan struct{})}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		c.state = &state
+	}
+	return c, nil
+}
+
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if t.secure {
+		l, err = tls.Listen("tcp", addr, t.conf)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hl := newHTTPListener(l)
+	ws := websocket.Server{
+		// browsers are not expected, any origin is accepted
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			c := &wsConn{Conn: ws, state: ws.Request().TLS, closed: make(chan struct{})}
+			if hl.push(c) {
+				// the connection is closed when the handler returns
+				<-c.closed
+			}
+		},
+	}
+	hl.serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == t.path && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		t.fallback.ServeHTTP(w, r)
+	}))
+	return hl, nil
+}
+
+// wsConn lets the handler of an upgraded connection return once it is
+// closed, and exposes the state of the TLS connection under it.
+type wsConn struct {
+	*websocket.Conn
+	state     *tls.ConnectionState // nil over ws
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ConnectionState exposes the TLS state of the connection for channel
+// binding, the zero state over ws.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return err
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfigs returns the TLS configs of a server with a self-signed
+// certificate and of a client trusting it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sproxy test"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	return server, client
+}
+
+// dialPair dials a connection of transport name and returns both ends,
+// some data went through them.
+func dialPair(t *testing.T, name string) (client, server net.Conn) {
+	t.Helper()
+	sconf, cconf := testTLSConfigs(t)
+	st, err := New(name, &Config{TLS: sconf, Path: "/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := New(name, &Config{TLS: cconf, Path: "/p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := st.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err = ct.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	// h2 servers only see a stream once it sends something
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { server.Close() })
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	return client, server
+}
+
+// exportedKey returns the channel binding of conn as pipes export it.
+func exportedKey(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	tc, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		t.Fatalf("%T does not expose its TLS state", conn)
+	}
+	state := tc.ConnectionState()
+	if !state.HandshakeComplete {
+		t.Fatalf("%T exposes an incomplete TLS state", conn)
+	}
+	b, err := state.ExportKeyingMaterial("EXPORTER-sproxy-test", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWebSocketSecureConnectionState(t *testing.T) {
+	client, server := dialPair(t, WebSocketSecure)
+	if !bytes.Equal(exportedKey(t, client), exportedKey(t, server)) {
+		t.Fatal("ends of a wss connection export different keys")
+	}
+}